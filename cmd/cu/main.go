@@ -50,6 +50,16 @@ var (
 			defer dag.Close()
 
 			environment.Initialize(dag)
+			defer environment.Shutdown(context.WithoutCancel(ctx))
+
+			if v, ok := os.LookupEnv("CU_REGISTRY_MIRRORS"); ok {
+				mirrors, err := environment.ParseRegistryMirrors(v)
+				if err != nil {
+					return err
+				}
+				environment.SetRegistryMirrors(mirrors)
+			}
+
 			return mcpserver.RunStdioServer(ctx)
 		},
 	}
@@ -51,6 +51,17 @@ var terminalCmd = &cobra.Command{
 			return err
 		}
 
-		return env.Terminal(ctx)
+		record, _ := app.Flags().GetBool("record")
+		if err := env.Terminal(ctx, environment.TerminalOpts{Record: record}); err != nil {
+			return err
+		}
+		if record {
+			return repo.Update(ctx, env, "Terminal session", "Recorded terminal session")
+		}
+		return nil
 	},
 }
+
+func init() {
+	terminalCmd.Flags().Bool("record", false, "Record the session in the environment log")
+}
@@ -0,0 +1,66 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+type Artifact struct {
+	// Path is the absolute path of the artifact in the container.
+	Path string `json:"path"`
+	// Contents of a file artifact, when it isn't exported to the host.
+	Contents string `json:"contents,omitempty"`
+	// HostPath is where the artifact was exported, with RunOpts.ArtifactsDir.
+	HostPath string `json:"host_path,omitempty"`
+}
+
+// collectArtifacts retrieves RunOpts.ArtifactPaths from the container. Missing
+// artifacts don't fail the run: they're reported as warnings.
+func (env *Environment) collectArtifacts(ctx context.Context, state *dagger.Container, opts RunOpts) ([]*Artifact, []string) {
+	artifacts := []*Artifact{}
+	warnings := []string{}
+	for _, artifactPath := range opts.ArtifactPaths {
+		if !path.IsAbs(artifactPath) {
+			artifactPath = path.Join(env.Config.Workdir, artifactPath)
+		}
+		artifact := &Artifact{Path: artifactPath}
+		if opts.ArtifactsDir != "" {
+			artifact.HostPath = filepath.Join(opts.ArtifactsDir, filepath.FromSlash(strings.TrimPrefix(artifactPath, "/")))
+		}
+
+		if file, err := state.File(artifactPath).Sync(ctx); err == nil {
+			if artifact.HostPath != "" {
+				_, err = file.Export(ctx, artifact.HostPath)
+			} else {
+				artifact.Contents, err = file.Contents(ctx)
+			}
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("failed to retrieve artifact %s: %s", artifactPath, err))
+				continue
+			}
+			artifacts = append(artifacts, artifact)
+			continue
+		}
+
+		dir, err := state.Directory(artifactPath).Sync(ctx)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("artifact %s not found", artifactPath))
+			continue
+		}
+		if artifact.HostPath == "" {
+			warnings = append(warnings, fmt.Sprintf("artifact %s is a directory: set an artifacts directory to export it to the host", artifactPath))
+			continue
+		}
+		if _, err := dir.Export(ctx, artifact.HostPath); err != nil {
+			warnings = append(warnings, fmt.Sprintf("failed to retrieve artifact %s: %s", artifactPath, err))
+			continue
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, warnings
+}
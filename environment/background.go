@@ -0,0 +1,1213 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+const (
+	defaultRestartBackoff = 5 * time.Second
+
+	// Background commands write their output, PID and exit code to a cache volume
+	// shared with the containers reading them, since the engine doesn't expose
+	// the logs of a running service.
+	backgroundLogsDir  = "/.cu/logs"
+	backgroundStdinDir = "/.cu/stdin"
+	backgroundPollRate = time.Second
+
+	defaultWaitForLogTimeout = time.Minute
+	defaultStartupGrace      = time.Second
+	startupLogsSize          = 4 * 1024
+	defaultMaxLogSize        = 1024 * 1024
+
+	ephemeralPortMin = 49152
+	ephemeralPortMax = 65535
+)
+
+type RestartPolicy struct {
+	// MaxRestarts is how many times the service is restarted before giving up.
+	MaxRestarts int
+	// Backoff is the delay between liveness checks and restarts (default: 5s).
+	Backoff time.Duration
+}
+
+// ServiceLimits bound the resources of a background command. The engine
+// doesn't support cgroup limits on services, so they're approximated with
+// ulimit, per process of the command rather than for the whole service.
+type ServiceLimits struct {
+	// MemoryBytes bounds the virtual memory (ulimit -v) of each process,
+	// not its resident memory: runtimes reserving a large address space
+	// (Java, Go, Node.js) may fail well below it, and the processes together
+	// may use more.
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+	// CPUTime bounds the total processor time (ulimit -t) of each process,
+	// after which it's killed. It doesn't throttle the CPU usage: a busy
+	// server is killed eventually, however many cores it's allowed.
+	CPUTime time.Duration `json:"cpu_time,omitempty"`
+}
+
+type RunBackgroundOpts struct {
+	UseEntrypoint bool
+
+	// Name identifies the service in ListServices and FindService. It must be
+	// unique within the environment.
+	Name string
+
+	// RestartPolicy restarts the service whenever its command exits, as
+	// recorded by the command wrapper: host tunnels keep accepting connections
+	// after the service crashed, so they can't tell. It requires a command.
+	RestartPolicy *RestartPolicy
+
+	// Env and Secrets are set on the service container only, leaving the
+	// environment state untouched. Secret values are redacted from the notes.
+	Env     []string
+	Secrets map[string]string
+
+	// WaitForLog is a regular expression matched against the command output:
+	// RunBackground returns once a line matches, or fails after WaitTimeout
+	// (default: 1m).
+	WaitForLog  string
+	WaitTimeout time.Duration
+
+	// ExposeOnHost tunnels the exposed ports to the host. The service still
+	// starts if the tunnel fails (e.g. on a remote engine), with only internal
+	// endpoints.
+	ExposeOnHost bool
+	// HostPorts maps exposed ports to the host ports to expose them on,
+	// instead of random ones, e.g. for stable URLs. RunBackground fails if
+	// one is already in use, unless AllowPortReassign: it's then replaced by
+	// the next free one, reported in the endpoint.
+	HostPorts         map[int]int
+	AllowPortReassign bool
+
+	// StartupGrace is how long to watch the command after it started: if it
+	// exits within that window, RunBackground fails with its output
+	// (default: 1s, negative to disable).
+	StartupGrace time.Duration
+
+	// Volumes mounts persistent volumes, keyed by mount path, e.g.
+	// {"/var/lib/postgresql/data": "pgdata"}. A volume keeps its data across
+	// restarts of the service and is shared by the services of the environment
+	// mounting the same volume name.
+	Volumes map[string]string
+
+	// Limits bound the resources the command can use. They're enforced with
+	// ulimit rather than cgroups, see ServiceLimits.
+	Limits *ServiceLimits
+
+	// ProbeHealth probes common health paths (/health, /healthz, /) on every
+	// exposed port once the service started and reports which one answered.
+	ProbeHealth bool
+
+	// MaxLogSize caps the captured output in bytes (default: 1MiB, negative
+	// for unbounded). Past it, the oldest half is dropped and replaced by a
+	// marker. Images without mkfifo keep the whole output.
+	MaxLogSize int64
+
+	// DependsOn names running services (background or configured) to bind
+	// to the command container, reachable by their name as hostname.
+	DependsOn []string
+
+	// DetectPort exposes the first port announced in the command output,
+	// such as http://localhost:3000, instead of explicit ports. The command
+	// must listen on all interfaces to be reachable, not only localhost.
+	// WaitTimeout bounds the detection (default: 1m). When the service is
+	// restarted by its RestartPolicy or RestartOnChange and announces another
+	// port, it's rebound to it, keeping the external endpoint.
+	DetectPort bool
+
+	// Stdin is fed to the command once at launch, e.g. its configuration. It
+	// is mounted as a secret, never recorded in the notes or the persisted
+	// state: the service can't be reattached after a server restart.
+	Stdin []byte
+
+	// TunnelMetrics counts the connections and bytes going through the host
+	// tunnels, reported by Service.Metrics. It adds a proxy on the host in
+	// front of each tunnel.
+	TunnelMetrics bool
+
+	// RestartOnChange restarts the service with the new workdir whenever the
+	// environment changes, e.g. after a file write or a sync from Watch, for
+	// hot reloading without a framework watcher. Bursts of changes are
+	// debounced into a single restart.
+	RestartOnChange bool
+
+	// DrainTimeout drains the host tunnels when the service is stopped: they
+	// stop accepting connections, and in-flight ones get up to DrainTimeout
+	// to complete before the command is sent SIGTERM. Connections are tracked
+	// by the same host proxy as TunnelMetrics.
+	DrainTimeout time.Duration
+
+	// TLS terminates TLS on the host side of the tunnels with a self-signed
+	// certificate for localhost, for clients refusing plain HTTP: external
+	// endpoints are https:// URLs and the certificate to trust is returned
+	// with them. It uses the same host proxy as TunnelMetrics.
+	TLS bool
+
+	// Protocols maps exposed ports to their protocol, TCP when unspecified,
+	// e.g. UDP for a DNS server, including 0 for the auto-allocated port. UDP
+	// ports aren't proxied on the host, so TunnelMetrics, DrainTimeout, TLS
+	// and ProbeHealth only apply to TCP ports.
+	Protocols map[int]dagger.NetworkProtocol
+}
+
+// protocol returns the protocol of an exposed port.
+func (opts RunBackgroundOpts) protocol(port int) dagger.NetworkProtocol {
+	if protocol, ok := opts.Protocols[port]; ok {
+		return protocol
+	}
+	return dagger.NetworkProtocolTcp
+}
+
+// announcedPortRegexp matches the addresses servers print when they start
+// listening, e.g. "http://localhost:3000" or "listening on 0.0.0.0:8080".
+var announcedPortRegexp = regexp.MustCompile(`(?:localhost|127\.0\.0\.1|0\.0\.0\.0|\[::1?\]):(\d{2,5})\b`)
+
+// Environments are reloaded for every operation, so background services are
+// tracked per environment ID for the lifetime of the process.
+var (
+	backgroundMu       sync.Mutex
+	backgroundServices = map[string][]*Service{}
+	// stoppedServices are never persisted again, even though an environment
+	// loaded before they stopped still has their record.
+	stoppedServices = map[string]bool{}
+)
+
+func serviceVolume(envID, name string) string {
+	return "container-use-" + strings.ReplaceAll(envID, "/", "-") + "-" + name
+}
+
+func backgroundLogsVolume(envID string) string {
+	return "container-use-logs-" + strings.ReplaceAll(envID, "/", "-")
+}
+
+// backgroundScript wraps a background command to record its output, PID and
+// exit code, and to apply its resource limits. The output still goes to the
+// stdout and stderr of the service, and the script exits with the exit code of
+// the command, so that the engine reports a failed startup as before. The
+// command replaces the subshell applying the limits, and the signals stopping
+// the service are forwarded to it, so that it can shut down gracefully.
+func backgroundScript(id, shell, command string, limits *ServiceLimits, maxLogSize int64, stdin bool) string {
+	prefix := path.Join(backgroundLogsDir, id)
+	script := &strings.Builder{}
+	fmt.Fprintf(script, "rm -f %[1]s.exit %[1]s.pid %[1]s.stdout %[1]s.stderr %[1]s.logpipe %[1]s.log.1 %[1]s.log.dropped\n: >%[1]s.log\n", prefix)
+	// A service replaced by a new instance (see replaceService) stops after
+	// the new one started: only the latest instance records its exit code.
+	fmt.Fprintf(script, "instance=$(cat /proc/sys/kernel/random/uuid)\necho $instance >%s.instance\n", prefix)
+	// Each line of stdout and stderr is copied to the service output and to
+	// a single writer appending it to the log, so that both streams count
+	// towards the same size. The log is reopened for every line so that it
+	// can be rotated by renaming it: past half the maximum size, the log
+	// replaces the previous one. Without mkfifo, the output only goes to the
+	// log, unbounded.
+	if maxLogSize == 0 {
+		maxLogSize = defaultMaxLogSize
+	}
+	// The last line may have no newline
+	script.WriteString("cu_tee() {\nwhile IFS= read -r line; do\nprintf '%s\\n' \"$line\"\nprintf '%s\\n' \"$line\" >&3\ndone\n")
+	script.WriteString("if [ -n \"$line\" ]; then\nprintf '%s' \"$line\"\nprintf '%s\\n' \"$line\" >&3\nfi\n}\n")
+	fmt.Fprintf(script, "cu_log() {\nsize=0\nwhile IFS= read -r line; do\nprintf '%%s\\n' \"$line\" >>%s.log\n", prefix)
+	if maxLogSize > 0 {
+		fmt.Fprintf(script, "size=$((size + ${#line} + 1))\nif [ $size -gt %d ]; then\n", maxLogSize/2)
+		fmt.Fprintf(script, "if [ -e %[1]s.log.1 ]; then : >%[1]s.log.dropped; fi\nmv -f %[1]s.log %[1]s.log.1\nsize=0\nfi\n", prefix)
+	}
+	script.WriteString("done\n}\n")
+	fmt.Fprintf(script, "if mkfifo %[1]s.stdout %[1]s.stderr %[1]s.logpipe 2>/dev/null; then\n", prefix)
+	fmt.Fprintf(script, "cu_log <%[1]s.logpipe &\nexec 3>%[1]s.logpipe\ncu_tee <%[1]s.stdout &\ncu_tee <%[1]s.stderr >&2 &\nexec 3>&- >%[1]s.stdout 2>%[1]s.stderr\n", prefix)
+	fmt.Fprintf(script, "else\nexec >>%[1]s.log 2>&1\nfi\n", prefix)
+	script.WriteString("(\n")
+	// Limits only apply to the command subshell
+	if limits != nil && limits.MemoryBytes > 0 {
+		fmt.Fprintf(script, "ulimit -v %d || exit 1\n", max(limits.MemoryBytes/1024, 1))
+	}
+	if limits != nil && limits.CPUTime > 0 {
+		fmt.Fprintf(script, "ulimit -t %d || exit 1\n", max(int64(limits.CPUTime.Seconds()), 1))
+	}
+	if stdin {
+		fmt.Fprintf(script, "exec %s -c %s\n) <%s &\n", shell, shellQuote(command), path.Join(backgroundStdinDir, id))
+	} else {
+		fmt.Fprintf(script, "exec %s -c %s\n) &\n", shell, shellQuote(command))
+	}
+	fmt.Fprintf(script, "pid=$!\necho $pid >%[1]s.pid\n", prefix)
+	// Background commands ignore SIGINT, so it's forwarded as SIGTERM
+	script.WriteString("trap 'kill -TERM $pid 2>/dev/null' TERM INT\n")
+	// A trapped signal interrupts wait before the command exits
+	script.WriteString("wait $pid\ncode=$?\nwhile kill -0 $pid 2>/dev/null; do\nwait $pid\ncode=$?\ndone\n")
+	// Let the logs be written up to the end of the output before exiting
+	fmt.Fprintf(script, "if [ \"$(cat %[1]s.instance)\" = \"$instance\" ]; then\necho $code >%[1]s.exit\nfi\nexec >&- 2>&-\nwait\nrm -f %[1]s.stdout %[1]s.stderr %[1]s.logpipe\nexit $code", prefix)
+	return script.String()
+}
+
+const maxPortReassignAttempts = 100
+
+// nextFreeHostPort returns the first port, starting at port, that can be
+// listened on.
+func nextFreeHostPort(port int, protocol dagger.NetworkProtocol) (int, error) {
+	for candidate := port; candidate < port+maxPortReassignAttempts && candidate <= ephemeralPortMax; candidate++ {
+		if hostPortFree(candidate, protocol) {
+			return candidate, nil
+		}
+	}
+	return 0, fmt.Errorf("no free host port found from %d", port)
+}
+
+func hostPortFree(port int, protocol dagger.NetworkProtocol) bool {
+	address := fmt.Sprintf(":%d", port)
+	if protocol == dagger.NetworkProtocolUdp {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// checkHostPorts fails if a requested host port is invalid or, without
+// AllowPortReassign, already in use, rather than starting a service whose
+// tunnel can't bind it.
+func (opts RunBackgroundOpts) checkHostPorts(ports []int) error {
+	if !opts.ExposeOnHost {
+		return nil
+	}
+	requested := map[int]int{}
+	for _, port := range ports {
+		hostPort, ok := opts.HostPorts[port]
+		if !ok || hostPort == 0 {
+			continue
+		}
+		if hostPort < 0 || hostPort > ephemeralPortMax {
+			return fmt.Errorf("invalid host port %d for port %d", hostPort, port)
+		}
+		if other, ok := requested[hostPort]; ok {
+			return fmt.Errorf("host port %d is requested for both ports %d and %d", hostPort, other, port)
+		}
+		requested[hostPort] = port
+		if !opts.AllowPortReassign && !hostPortFree(hostPort, opts.protocol(port)) {
+			return fmt.Errorf("host port %d requested for port %d is already in use", hostPort, port)
+		}
+	}
+	return nil
+}
+
+// allocatePorts replaces a 0 port with a free ephemeral port, returned
+// separately so that the command can be told which port to listen on.
+func allocatePorts(ports []int) ([]int, int, error) {
+	resolved := slices.Clone(ports)
+	autoPort := 0
+	for i, port := range resolved {
+		if port != 0 {
+			continue
+		}
+		if autoPort != 0 {
+			return nil, 0, errors.New("only one port can be auto-allocated")
+		}
+		for autoPort == 0 || slices.Contains(ports, autoPort) {
+			autoPort = ephemeralPortMin + rand.IntN(ephemeralPortMax-ephemeralPortMin+1)
+		}
+		resolved[i] = autoPort
+	}
+	return resolved, autoPort, nil
+}
+
+func (env *Environment) trackService(service *Service) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	backgroundServices[env.ID] = append(backgroundServices[env.ID], service)
+}
+
+// backgroundRecords returns the background services to persist: the ones
+// running in this process and the ones not reattached yet.
+func (env *Environment) backgroundRecords() []*BackgroundService {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	records := []*BackgroundService{}
+	running := map[string]bool{}
+	for _, service := range backgroundServices[env.ID] {
+		if service.state == "" {
+			continue
+		}
+		running[service.ID] = true
+		records = append(records, &BackgroundService{
+			ID:              service.ID,
+			Name:            service.Config.Name,
+			Command:         service.Config.Command,
+			Ports:           service.Config.ExposedPorts,
+			Env:             service.Config.Env,
+			Container:       service.state,
+			Args:            service.args,
+			UseEntrypoint:   service.entrypoint,
+			Limits:          service.Limits,
+			Volumes:         service.Volumes,
+			RestartOnChange: service.restartOnChange,
+			Protocols:       service.Endpoints.protocols(),
+			Secrets:         service.secrets,
+			Stdin:           service.stdin,
+		})
+	}
+	for _, record := range env.detached {
+		if !running[record.ID] && !stoppedServices[record.ID] {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// HasDetachedServices reports whether persisted background services aren't
+// running in this process, see ReattachServices.
+func (env *Environment) HasDetachedServices() bool {
+	return len(env.detached) > 0
+}
+
+// ReattachServices restarts the persisted background services that aren't
+// running in this process, e.g. after a server restart, and tunnels their
+// ports again. Services that can't be restarted are reported and forgotten.
+// See Repository.ReattachServices, which persists the result.
+func (env *Environment) ReattachServices(ctx context.Context) error {
+	backgroundMu.Lock()
+	running := map[string]bool{}
+	for _, service := range backgroundServices[env.ID] {
+		running[service.ID] = true
+	}
+	backgroundMu.Unlock()
+
+	var errs []error
+	for _, record := range env.detached {
+		if running[record.ID] {
+			continue
+		}
+		if err := env.reattachService(ctx, record); err != nil {
+			env.Notes.Add("$ %s &\nservice lost: %s\n\n", record.Command, err)
+			errs = append(errs, fmt.Errorf("service %s (%s) lost: %w", record.ID, record.Command, err))
+		}
+	}
+	env.detached = nil
+	return errors.Join(errs...)
+}
+
+func (env *Environment) reattachService(ctx context.Context, record *BackgroundService) error {
+	if record.Stdin {
+		return errors.New("its stdin isn't persisted, start the service again")
+	}
+	if len(record.Secrets) > 0 {
+		return fmt.Errorf("the values of its secrets %s aren't persisted, start the service again", strings.Join(slices.Sorted(maps.Keys(record.Secrets)), ", "))
+	}
+	svc, err := env.client().LoadContainerFromID(dagger.ContainerID(record.Container)).
+		AsService(dagger.ContainerAsServiceOpts{
+			Args:          record.Args,
+			UseEntrypoint: record.UseEntrypoint,
+		}).Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoints, err := env.exposeService(ctx, svc, record.Ports, RunBackgroundOpts{
+		ExposeOnHost: true,
+		Protocols:    record.Protocols,
+	})
+	if err != nil {
+		return err
+	}
+
+	env.trackService(&Service{
+		ID: record.ID,
+		Config: &ServiceConfig{
+			Name:         record.Name,
+			Command:      record.Command,
+			ExposedPorts: record.Ports,
+			Env:          record.Env,
+		},
+		Endpoints:       endpoints,
+		Limits:          record.Limits,
+		Volumes:         record.Volumes,
+		svc:             svc,
+		envID:           env.ID,
+		client:          env.client(),
+		restartOnChange: record.RestartOnChange,
+		state:           record.Container,
+		args:            record.Args,
+		entrypoint:      record.UseEntrypoint,
+	})
+	env.Notes.Add("$ %s &\nservice reattached\n\n", record.Command)
+	return nil
+}
+
+// ListServices returns the configured services along with the ones started by RunBackground.
+func (env *Environment) ListServices() []*Service {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	services := []*Service{}
+	for _, service := range slices.Concat(env.Services, backgroundServices[env.ID]) {
+		snapshot := *service
+		services = append(services, &snapshot)
+	}
+	return services
+}
+
+// FindService returns the service with the given name, or ID for unnamed
+// background services.
+func (env *Environment) FindService(name string) (*Service, error) {
+	for _, service := range env.ListServices() {
+		if service.Config.Name == name || (service.ID != "" && service.ID == name) {
+			return service, nil
+		}
+	}
+	return nil, fmt.Errorf("service %s not found", name)
+}
+
+type ServiceInfo struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name,omitempty"`
+	Command   string           `json:"command"`
+	Endpoints EndpointMappings `json:"endpoints"`
+	Restarts  int              `json:"restarts,omitempty"`
+}
+
+// BackgroundServices returns the services started by RunBackground that are
+// still running, unlike ListServices which includes the configured ones.
+func (env *Environment) BackgroundServices() []ServiceInfo {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	services := []ServiceInfo{}
+	for _, service := range backgroundServices[env.ID] {
+		services = append(services, ServiceInfo{
+			ID:        service.ID,
+			Name:      service.Config.Name,
+			Command:   service.Config.Command,
+			Endpoints: service.Endpoints,
+			Restarts:  service.Restarts,
+		})
+	}
+	return services
+}
+
+// backgroundService returns the tracked service started by RunBackground with
+// the ID or name.
+func (env *Environment) backgroundService(serviceID string) (*Service, error) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	idx := slices.IndexFunc(backgroundServices[env.ID], func(service *Service) bool {
+		return service.ID == serviceID || (service.Config.Name != "" && service.Config.Name == serviceID)
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("background service %s not found", serviceID)
+	}
+	return backgroundServices[env.ID][idx], nil
+}
+
+// StopBackground stops a service started by RunBackground, by the ID it
+// returned or its name, along with its host tunnels.
+func (env *Environment) StopBackground(ctx context.Context, serviceID string) error {
+	service, err := env.backgroundService(serviceID)
+	if err != nil {
+		return err
+	}
+
+	if err := service.Stop(ctx); err != nil {
+		return err
+	}
+	env.Notes.Add("$ %s &\nservice stopped\n\n", service.Config.Command)
+	return nil
+}
+
+type BackgroundLogsOpts struct {
+	// Record adds the logs to the environment notes, to keep them in the
+	// history.
+	Record bool
+}
+
+// BackgroundLogs returns the combined output of a service started by
+// RunBackground so far, by the ID it returned or its name.
+func (env *Environment) BackgroundLogs(ctx context.Context, serviceID string, opts BackgroundLogsOpts) (string, error) {
+	service, err := env.backgroundService(serviceID)
+	if err != nil {
+		return "", err
+	}
+	logs, err := service.Logs(ctx)
+	if err != nil {
+		return "", err
+	}
+	if opts.Record {
+		env.Notes.Add("$ %s &\nlogs:\n%s\n\n", service.Config.Command, truncate(logs))
+	}
+	return logs, nil
+}
+
+// RebindService moves a background service from one internal port to
+// another, e.g. after a restart made the command listen on a different port.
+// The service is started again with the new port exposed and its host tunnel
+// moves to it, keeping the host port so that the external endpoint stays the
+// same. The service is left as it was if the rebinding fails.
+func (env *Environment) RebindService(ctx context.Context, name string, from, to int) (*EndpointMapping, error) {
+	service, err := env.backgroundService(name)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := env.rebindService(ctx, service, from, to)
+	if err != nil {
+		return nil, err
+	}
+	env.Notes.Add("$ %s &\nport %d rebound to %d %s\n\n", service.Config.Command, from, to, endpoint.External)
+	return endpoint, nil
+}
+
+func (env *Environment) rebindService(ctx context.Context, service *Service, from, to int) (*EndpointMapping, error) {
+	backgroundMu.Lock()
+	previous, ok := service.Endpoints[from]
+	_, exists := service.Endpoints[to]
+	state := service.state
+	backgroundMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("service %s doesn't expose port %d", service.ID, from)
+	}
+	if exists {
+		return nil, fmt.Errorf("service %s already exposes port %d", service.ID, to)
+	}
+
+	protocol := previous.protocol()
+	serviceState := env.client().LoadContainerFromID(dagger.ContainerID(state)).
+		WithoutExposedPort(from, dagger.ContainerWithoutExposedPortOpts{
+			Protocol: protocol,
+		}).
+		WithExposedPort(to, dagger.ContainerWithExposedPortOpts{
+			Protocol:    protocol,
+			Description: fmt.Sprintf("Port %d", to),
+		})
+	if err := env.replaceService(ctx, service, serviceState, map[int]int{from: to}); err != nil {
+		return nil, fmt.Errorf("failed to rebind port %d to %d: %w", from, to, err)
+	}
+
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	return service.Endpoints[to], nil
+}
+
+// followDetectedPort waits for a restarted service started with DetectPort to
+// announce its port again, and rebinds the service if the port changed.
+func (env *Environment) followDetectedPort(ctx context.Context, service *Service) error {
+	backgroundMu.Lock()
+	from := 0
+	for port, endpoint := range service.Endpoints {
+		if endpoint.Detected {
+			from = port
+		}
+	}
+	backgroundMu.Unlock()
+	if from == 0 {
+		return nil
+	}
+
+	// Let the new instance clear the logs of the previous one
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(backgroundPollRate):
+	}
+	line, err := service.waitForLog(ctx, announcedPortRegexp, defaultWaitForLogTimeout)
+	if err != nil {
+		return fmt.Errorf("no port detected after the restart: %w", err)
+	}
+	to, _ := strconv.Atoi(announcedPortRegexp.FindStringSubmatch(line)[1])
+	if to == from {
+		return nil
+	}
+
+	endpoint, err := env.rebindService(ctx, service, from, to)
+	if err != nil {
+		return err
+	}
+	slog.Info("Rebound background service to its new port", "environment", env.ID, "command", service.Config.Command, "from", from, "to", to, "external", endpoint.External)
+	env.backgroundNote(ctx, "$ %s &\ndetected port %d, rebound from %d %s\n\n", service.Config.Command, to, from, endpoint.External)
+	return nil
+}
+
+// replaceService starts a new instance of the service from the state and
+// moves the host tunnels to it, keeping their host ports, with the ports in
+// moves (e.g. {3000: 3001}) changing. The new instance replaces the previous
+// one once it started and got every tunnel: otherwise it's stopped, and the
+// previous one keeps running with its tunnels.
+func (env *Environment) replaceService(ctx context.Context, service *Service, serviceState *dagger.Container, moves map[int]int) error {
+	serviceStateID, err := serviceState.ID(ctx)
+	if err != nil {
+		return err
+	}
+	backgroundMu.Lock()
+	previousSvc := service.svc
+	previousEndpoints := service.Endpoints
+	backgroundMu.Unlock()
+
+	svc, err := serviceState.AsService(dagger.ContainerAsServiceOpts{
+		Args:          service.args,
+		UseEntrypoint: service.entrypoint,
+	}).Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	moved := func(port int) int {
+		if to, ok := moves[port]; ok {
+			return to
+		}
+		return port
+	}
+	endpoints := EndpointMappings{}
+	for port, previous := range previousEndpoints {
+		if err := env.moveEndpoint(ctx, svc, moved(port), previousSvc, port, previous, endpoints); err != nil {
+			// Move the tunnels already moved back to the previous instance
+			for port, previous := range previousEndpoints {
+				if endpoint, ok := endpoints[moved(port)]; ok {
+					if err := env.retunnel(ctx, previousSvc, port, svc, moved(port), endpoint, previous); err != nil {
+						slog.Error("Failed to restore the host tunnel", "environment", env.ID, "command", service.Config.Command, "port", port, "err", err)
+					}
+				}
+			}
+			if _, err := svc.Stop(ctx); err != nil {
+				slog.Warn("Failed to stop background service", "environment", env.ID, "command", service.Config.Command, "err", err)
+			}
+			return err
+		}
+	}
+
+	backgroundMu.Lock()
+	service.svc = svc
+	service.state = string(serviceStateID)
+	service.Endpoints = endpoints
+	if len(moves) > 0 {
+		// Snapshots returned by ListServices share the previous config
+		config := *service.Config
+		config.ExposedPorts = make([]int, 0, len(config.ExposedPorts))
+		for _, port := range service.Config.ExposedPorts {
+			config.ExposedPorts = append(config.ExposedPorts, moved(port))
+		}
+		service.Config = &config
+	}
+	backgroundMu.Unlock()
+
+	if _, err := previousSvc.Stop(ctx); err != nil {
+		slog.Warn("Failed to stop the previous instance of background service", "environment", env.ID, "command", service.Config.Command, "err", err)
+	}
+	return nil
+}
+
+// moveEndpoint adds the endpoint of port of svc to endpoints, with the host
+// tunnel of the previous endpoint on previousPort of previousSvc.
+func (env *Environment) moveEndpoint(ctx context.Context, svc *dagger.Service, port int, previousSvc *dagger.Service, previousPort int, previous *EndpointMapping, endpoints EndpointMappings) error {
+	internalEndpoint, err := svc.Endpoint(ctx, dagger.ServiceEndpointOpts{
+		Port: port,
+	})
+	if err != nil {
+		return err
+	}
+	endpoint := &EndpointMapping{
+		Internal:          internalEndpoint,
+		ReassignedFrom:    previous.ReassignedFrom,
+		Detected:          previous.Detected,
+		Certificate:       previous.Certificate,
+		Protocol:          previous.Protocol,
+		HostPortRequested: previous.HostPortRequested,
+	}
+	if err := env.retunnel(ctx, svc, port, previousSvc, previousPort, previous, endpoint); err != nil {
+		return err
+	}
+	endpoints[port] = endpoint
+	return nil
+}
+
+// retunnel moves the host tunnel of the previous endpoint, if any, from
+// previousPort of previousSvc to port of svc, keeping the same host port. If
+// the new tunnel fails, the previous one is kept or bound again.
+func (env *Environment) retunnel(ctx context.Context, svc *dagger.Service, port int, previousSvc *dagger.Service, previousPort int, previous, endpoint *EndpointMapping) error {
+	if previous.proxy != nil {
+		// The proxy keeps the host port, only its backend changes
+		tunnel, tunnelEndpoint, err := env.tunnelToHost(ctx, svc, port, 0, endpoint.protocol())
+		if err != nil {
+			return fmt.Errorf("failed to rebind port %d: %w", port, err)
+		}
+		previous.proxy.setBackend(tunnelEndpoint)
+		if _, err := previous.tunnel.Stop(ctx); err != nil {
+			slog.Warn("Failed to stop the previous host tunnel", "environment", env.ID, "port", previousPort, "err", err)
+		}
+		backgroundMu.Lock()
+		defer backgroundMu.Unlock()
+		endpoint.tunnel = tunnel
+		endpoint.proxy = previous.proxy
+		endpoint.External = previous.External
+		return nil
+	}
+	if previous.tunnel == nil {
+		return nil
+	}
+
+	_, hostPort, err := net.SplitHostPort(previous.External)
+	if err != nil {
+		return err
+	}
+	externalPort, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return err
+	}
+	// The host port must be released before binding it again
+	if _, err := previous.tunnel.Stop(ctx); err != nil {
+		return err
+	}
+	tunnel, external, err := env.tunnelToHost(ctx, svc, port, externalPort, endpoint.protocol())
+	if err == nil {
+		backgroundMu.Lock()
+		defer backgroundMu.Unlock()
+		endpoint.tunnel = tunnel
+		endpoint.External = external
+		return nil
+	}
+	err = fmt.Errorf("failed to rebind host port %d: %w", externalPort, err)
+
+	restored, _, restoreErr := env.tunnelToHost(ctx, previousSvc, previousPort, externalPort, previous.protocol())
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	if restoreErr != nil {
+		previous.tunnel = nil
+		previous.External = ""
+		previous.Note = fmt.Sprintf("external access lost: %s", restoreErr)
+		return errors.Join(err, fmt.Errorf("failed to restore the previous tunnel: %w", restoreErr))
+	}
+	previous.tunnel = restored
+	return err
+}
+
+// scheduleReloads restarts the services started with RestartOnChange on the
+// new state, once it stopped changing for a while.
+func (env *Environment) scheduleReloads(ctx context.Context, state *dagger.Container) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+
+	for _, service := range backgroundServices[env.ID] {
+		if !service.restartOnChange {
+			continue
+		}
+		if service.reloadTimer != nil {
+			service.reloadTimer.Stop()
+		}
+		service.reloadTimer = time.AfterFunc(watchDebounce, func() {
+			if err := env.reloadService(ctx, service, state); err != nil {
+				slog.Error("Failed to restart background service on change", "environment", env.ID, "command", service.Config.Command, "err", err)
+				env.backgroundNote(ctx, "$ %s &\nfailed to restart on change: %s\n\n", service.Config.Command, err)
+				return
+			}
+			if err := env.followDetectedPort(ctx, service); err != nil {
+				slog.Error("Failed to rebind background service", "environment", env.ID, "command", service.Config.Command, "err", err)
+				env.backgroundNote(ctx, "$ %s &\nfailed to rebind: %s\n\n", service.Config.Command, err)
+			}
+		})
+	}
+}
+
+// reloadService starts the service again with the workdir of the state and
+// moves its host tunnels to the new instance, so that its endpoints don't
+// change. The previous instance keeps running until the new one started.
+func (env *Environment) reloadService(ctx context.Context, service *Service, state *dagger.Container) error {
+	backgroundMu.Lock()
+	stopped := stoppedServices[service.ID]
+	service.restarting = !stopped
+	serviceStateID := service.state
+	backgroundMu.Unlock()
+	if stopped {
+		return nil
+	}
+	defer func() {
+		backgroundMu.Lock()
+		service.restarting = false
+		backgroundMu.Unlock()
+	}()
+
+	workdir := env.Config.Workdir
+	serviceState := env.client().LoadContainerFromID(dagger.ContainerID(serviceStateID)).
+		WithoutDirectory(workdir).
+		WithDirectory(workdir, state.Directory(workdir))
+	if err := env.replaceService(ctx, service, serviceState, nil); err != nil {
+		return err
+	}
+
+	backgroundMu.Lock()
+	service.Restarts++
+	backgroundMu.Unlock()
+
+	env.backgroundNote(ctx, "$ %s &\nservice restarted on change\n\n", service.Config.Command)
+	return nil
+}
+
+// StopServices stops the background services of an environment and their
+// tunnels, e.g. before deleting it.
+func StopServices(ctx context.Context, envID string) error {
+	backgroundMu.Lock()
+	services := slices.Clone(backgroundServices[envID])
+	backgroundMu.Unlock()
+
+	var errs []error
+	for _, service := range services {
+		if err := service.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop service %s: %w", service.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (env *Environment) monitorService(ctx context.Context, service *Service, policy *RestartPolicy) {
+	backoff := policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backgroundMu.Lock()
+		stopped := stoppedServices[service.ID]
+		backgroundMu.Unlock()
+		if stopped {
+			return
+		}
+		if service.alive(ctx) {
+			continue
+		}
+
+		backgroundMu.Lock()
+		restarts := service.Restarts
+		backgroundMu.Unlock()
+		if restarts >= policy.MaxRestarts {
+			slog.Warn("Background service exceeded its restart limit", "environment", env.ID, "command", service.Config.Command, "restarts", restarts)
+			env.backgroundNote(ctx, "$ %s &\nservice stopped after %d restarts\n\n", service.Config.Command, restarts)
+			return
+		}
+
+		slog.Info("Restarting background service", "environment", env.ID, "command", service.Config.Command)
+		backgroundMu.Lock()
+		service.restarting = true
+		svc := service.svc
+		backgroundMu.Unlock()
+		if _, err := svc.Start(ctx); err != nil {
+			slog.Error("Failed to restart background service", "environment", env.ID, "command", service.Config.Command, "err", err)
+			continue
+		}
+
+		backgroundMu.Lock()
+		service.restarting = false
+		service.Restarts++
+		restarts = service.Restarts
+		backgroundMu.Unlock()
+		env.backgroundNote(ctx, "$ %s &\nservice restarted (%d/%d)\n\n", service.Config.Command, restarts, policy.MaxRestarts)
+		if err := env.followDetectedPort(ctx, service); err != nil {
+			slog.Error("Failed to rebind background service", "environment", env.ID, "command", service.Config.Command, "err", err)
+			env.backgroundNote(ctx, "$ %s &\nfailed to rebind: %s\n\n", service.Config.Command, err)
+		}
+	}
+}
+
+// alive reports whether the command of the service is still running, from the
+// exit file of the command wrapper (see backgroundScript). Probing the host
+// tunnels wouldn't do: they accept connections whether or not the service is
+// up.
+func (s *Service) alive(ctx context.Context) bool {
+	_, exited, err := s.readLogFile(ctx, s.ID+".exit")
+	// Unknown when the logs can't be read: don't restart a running service
+	return err != nil || !exited
+}
+
+// Stop stops the service and its tunnels, and forgets about it. Services
+// started with a DrainTimeout let their in-flight connections complete first.
+// Everything is stopped even if something fails to, and it's forgotten either
+// way: the errors are returned together.
+func (s *Service) Stop(ctx context.Context) error {
+	for _, endpoint := range s.Endpoints {
+		if endpoint.proxy != nil {
+			endpoint.proxy.Close()
+		}
+	}
+	if s.drainTimeout > 0 {
+		deadline := time.Now().Add(s.drainTimeout)
+		for port, endpoint := range s.Endpoints {
+			if endpoint.proxy != nil && !endpoint.proxy.wait(time.Until(deadline)) {
+				slog.Warn("Connections still open after the drain timeout", "service", s.ID, "port", port, "timeout", s.drainTimeout)
+			}
+		}
+	}
+	var errs []error
+	for port, endpoint := range s.Endpoints {
+		if endpoint.tunnel == nil {
+			continue
+		}
+		if _, err := endpoint.tunnel.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop the tunnel of port %d: %w", port, err))
+		}
+	}
+	if _, err := s.svc.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	if s.reloadTimer != nil {
+		s.reloadTimer.Stop()
+	}
+	backgroundServices[s.envID] = slices.DeleteFunc(backgroundServices[s.envID], func(other *Service) bool {
+		return other.svc == s.svc
+	})
+	stoppedServices[s.ID] = true
+	return errors.Join(errs...)
+}
+
+// Restart stops and starts the service again.
+func (s *Service) Restart(ctx context.Context) error {
+	backgroundMu.Lock()
+	s.restarting = true
+	backgroundMu.Unlock()
+	defer func() {
+		backgroundMu.Lock()
+		s.restarting = false
+		backgroundMu.Unlock()
+	}()
+
+	if _, err := s.svc.Stop(ctx); err != nil {
+		return err
+	}
+	if _, err := s.svc.Start(ctx); err != nil {
+		return err
+	}
+
+	backgroundMu.Lock()
+	s.Restarts++
+	backgroundMu.Unlock()
+	return nil
+}
+
+type ProcessState string
+
+const (
+	ProcessRunning    ProcessState = "running"
+	ProcessExited     ProcessState = "exited"
+	ProcessRestarting ProcessState = "restarting"
+	ProcessUnknown    ProcessState = "unknown"
+)
+
+type ProcessStatus struct {
+	State ProcessState `json:"state"`
+	// PID is the process ID of the command inside the service container, 0
+	// when unknown.
+	PID      int  `json:"pid,omitempty"`
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+// Status reports whether a background command is running. The engine doesn't
+// expose the processes of a service, so the state is read from the files the
+// command wrapper writes, only when asked. It's unknown for configured
+// services and when those files can't be read.
+func (s *Service) Status(ctx context.Context) *ProcessStatus {
+	backgroundMu.Lock()
+	// s may be a snapshot from ListServices: check the tracked service
+	restarting := slices.ContainsFunc(backgroundServices[s.envID], func(other *Service) bool {
+		return other.ID == s.ID && other.restarting
+	})
+	backgroundMu.Unlock()
+	if restarting {
+		return &ProcessStatus{State: ProcessRestarting}
+	}
+	if s.client == nil || s.ID == "" {
+		return &ProcessStatus{State: ProcessUnknown}
+	}
+
+	exitCode, exited, err := s.readLogFile(ctx, s.ID+".exit")
+	if err != nil {
+		return &ProcessStatus{State: ProcessUnknown}
+	}
+	if exited {
+		code, err := strconv.Atoi(strings.TrimSpace(exitCode))
+		if err != nil {
+			return &ProcessStatus{State: ProcessUnknown}
+		}
+		return &ProcessStatus{State: ProcessExited, ExitCode: &code}
+	}
+
+	status := &ProcessStatus{State: ProcessRunning}
+	// Services started before PIDs were recorded don't have the file
+	if pid, found, err := s.readLogFile(ctx, s.ID+".pid"); err == nil && found {
+		status.PID, _ = strconv.Atoi(strings.TrimSpace(pid))
+	}
+	return status
+}
+
+// Metrics returns the traffic of each exposed port through its host tunnel,
+// for services started with RunBackgroundOpts.TunnelMetrics.
+func (s *Service) Metrics() map[int]*TunnelMetrics {
+	metrics := map[int]*TunnelMetrics{}
+	for port, endpoint := range s.Endpoints {
+		if endpoint.proxy != nil {
+			metrics[port] = endpoint.proxy.metrics()
+		}
+	}
+	return metrics
+}
+
+// Logs returns the combined output of a background command so far.
+func (s *Service) Logs(ctx context.Context) (string, error) {
+	logs, found, err := s.readLogs(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("no logs available for service %s", s.ID)
+	}
+	return logs, nil
+}
+
+// Wait blocks until the background command exits and returns its exit code.
+func (s *Service) Wait(ctx context.Context) (int, error) {
+	for {
+		exitCode, found, err := s.readLogFile(ctx, s.ID+".exit")
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return strconv.Atoi(strings.TrimSpace(exitCode))
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backgroundPollRate):
+		}
+	}
+}
+
+// checkStartup fails if the command exited within the grace period, e.g. a
+// server crashing on startup or a daemon forking, reporting its output.
+func (s *Service) checkStartup(ctx context.Context, grace time.Duration) error {
+	if grace < 0 || s.args == nil {
+		return nil
+	}
+	if grace == 0 {
+		grace = defaultStartupGrace
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(grace):
+	}
+
+	exitCode, exited, err := s.readLogFile(ctx, s.ID+".exit")
+	if err != nil || !exited {
+		return err
+	}
+	return fmt.Errorf("command exited with code %s during startup%s", strings.TrimSpace(exitCode), s.startupLogs(ctx))
+}
+
+// startupLogs returns the end of the logs, formatted for an error message.
+func (s *Service) startupLogs(ctx context.Context) string {
+	logs, found, err := s.readLogs(ctx)
+	if err != nil || !found || strings.TrimSpace(logs) == "" {
+		return ""
+	}
+	if len(logs) > startupLogsSize {
+		logs = logs[len(logs)-startupLogsSize:]
+	}
+	return "\noutput:\n" + logs
+}
+
+// waitForLog polls the logs until a line matches the pattern and returns it.
+func (s *Service) waitForLog(ctx context.Context, pattern *regexp.Regexp, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		logs, _, err := s.readLogs(ctx)
+		if err != nil && ctx.Err() == nil {
+			return "", err
+		}
+		for line := range strings.Lines(logs) {
+			if pattern.MatchString(line) {
+				return strings.TrimRight(line, "\r\n"), nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no log line matched %q after %s", pattern, timeout)
+		case <-time.After(backgroundPollRate):
+		}
+	}
+}
+
+func (s *Service) readLogFile(ctx context.Context, name string) (string, bool, error) {
+	if s.client == nil || s.ID == "" {
+		return "", false, errors.New("logs are only available for background commands")
+	}
+
+	return readLogVolume(ctx, s.client, backgroundLogsVolume(s.envID), name)
+}
+
+// readLogs returns the output of the command, starting with the rotated log,
+// after a marker if older logs were dropped (see backgroundScript).
+func (s *Service) readLogs(ctx context.Context) (string, bool, error) {
+	if s.client == nil || s.ID == "" {
+		return "", false, errors.New("logs are only available for background commands")
+	}
+
+	prefix := path.Join(backgroundLogsDir, s.ID)
+	return execLogVolume(ctx, s.client, backgroundLogsVolume(s.envID), "sh", "-c", fmt.Sprintf(`[ -e %[1]s.log ] || exit 1
+if [ -e %[1]s.log.dropped ]; then echo '[older logs dropped]'; fi
+cat %[1]s.log.1 2>/dev/null
+cat %[1]s.log`, prefix))
+}
+
+// readLogVolume reads a file of a logs cache volume. The boolean is false when
+// the file doesn't exist (yet).
+func readLogVolume(ctx context.Context, client *dagger.Client, volume, name string) (string, bool, error) {
+	return execLogVolume(ctx, client, volume, "cat", path.Join(backgroundLogsDir, name))
+}
+
+// execLogVolume returns the output of the command run on a logs cache volume.
+// The boolean is false when the command fails, e.g. a file doesn't exist.
+func execLogVolume(ctx context.Context, client *dagger.Client, volume string, args ...string) (string, bool, error) {
+	contents, err := client.Container().
+		From(alpineImage).
+		WithMountedCache(backgroundLogsDir, client.CacheVolume(volume)).
+		// The files keep changing: never reuse a previous read
+		WithEnvVariable("CU_CACHE_BUSTER", time.Now().String()).
+		WithExec(args).
+		Stdout(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return contents, true, nil
+}
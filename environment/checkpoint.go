@@ -0,0 +1,369 @@
+package environment
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"dagger.io/dagger"
+)
+
+const (
+	// localCheckpointScheme prefixes the references returned by
+	// CheckpointLocal: oci-layout:///path/to/store@sha256:...
+	localCheckpointScheme = "oci-layout://"
+
+	ociLayoutFile    = "oci-layout"
+	ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+	ociIndexFile     = "index.json"
+	ociStoreLockFile = ".lock"
+	ociRefAnnotation = "org.opencontainers.image.ref.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    json.RawMessage   `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest covers both image manifests and indexes, to find the blobs they
+// reference.
+type ociManifest struct {
+	Config    *ociDescriptor  `json:"config,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+}
+
+// CheckpointLocal saves the current state to an OCI image layout directory,
+// created if needed, for users without a registry. It returns a reference to
+// create environments from with LoadLocalCheckpoint. Blobs are stored by
+// digest, so checkpoints share their common layers, and the store is locked
+// while it's updated so that concurrent checkpoints keep each other's entries.
+func (env *Environment) CheckpointLocal(ctx context.Context, dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	tarball, err := os.CreateTemp("", "container-use-checkpoint-*.tar")
+	if err != nil {
+		return "", err
+	}
+	tarball.Close()
+	defer os.Remove(tarball.Name())
+	if _, err := env.container.AsTarball().Export(ctx, tarball.Name()); err != nil {
+		return "", fmt.Errorf("failed to export the container: %w", err)
+	}
+
+	unlock, err := lockOCIStore(dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	descriptor, err := extractOCITarball(tarball.Name(), dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to write checkpoint to %s: %w", dir, err)
+	}
+	if descriptor.Annotations == nil {
+		descriptor.Annotations = map[string]string{}
+	}
+	descriptor.Annotations[ociRefAnnotation] = fmt.Sprintf("%s-v%d", strings.ReplaceAll(env.ID, "/", "-"), env.History.LatestVersion())
+
+	index := &ociIndex{SchemaVersion: 2}
+	if data, err := os.ReadFile(filepath.Join(dir, ociIndexFile)); err == nil {
+		if err := json.Unmarshal(data, index); err != nil {
+			return "", fmt.Errorf("invalid OCI layout in %s: %w", dir, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if !slices.ContainsFunc(index.Manifests, func(existing ociDescriptor) bool {
+		return existing.Digest == descriptor.Digest
+	}) {
+		index.Manifests = append(index.Manifests, *descriptor)
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ociIndexFile), data); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ociLayoutFile), []byte(ociLayoutVersion)); err != nil {
+		return "", err
+	}
+
+	return localCheckpointScheme + dir + "@" + descriptor.Digest, nil
+}
+
+// LoadLocalCheckpoint loads the container saved by CheckpointLocal, e.g. to
+// create an environment from it.
+func LoadLocalCheckpoint(ctx context.Context, client *dagger.Client, ref string) (*dagger.Container, error) {
+	if client == nil {
+		client = dag
+	}
+	dir, digest, ok := strings.Cut(strings.TrimPrefix(ref, localCheckpointScheme), "@")
+	if !ok || !strings.HasPrefix(ref, localCheckpointScheme) {
+		return nil, fmt.Errorf("invalid local checkpoint %q, expected %s<dir>@<digest>", ref, localCheckpointScheme)
+	}
+
+	unlock, err := lockOCIStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(filepath.Join(dir, ociIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI layout in %s: %w", dir, err)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid OCI layout in %s: %w", dir, err)
+	}
+	idx := slices.IndexFunc(index.Manifests, func(descriptor ociDescriptor) bool {
+		return descriptor.Digest == digest
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("checkpoint %s not found in %s", digest, dir)
+	}
+
+	// Only the blobs of this checkpoint go in the tarball to import
+	tarball, err := os.CreateTemp("", "container-use-checkpoint-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tarball.Name())
+	err = writeOCITarball(tarball, dir, index.Manifests[idx])
+	if closeErr := tarball.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", digest, err)
+	}
+
+	container, err := client.Container().Import(client.Host().File(tarball.Name())).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import checkpoint %s: %w", digest, err)
+	}
+	return container, nil
+}
+
+// lockOCIStore serializes the updates of a store between processes.
+func lockOCIStore(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, ociStoreLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", dir, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func blobPath(dir, digest string) (string, error) {
+	algorithm, hash, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || hash == "" || strings.ContainsAny(digest, "/\\.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(dir, "blobs", algorithm, hash), nil
+}
+
+// extractOCITarball adds the blobs of an exported image to the store and
+// returns the descriptor of the image. Blobs are streamed to disk and checked
+// against their digest.
+func extractOCITarball(tarballPath, dir string) (*ociDescriptor, error) {
+	f, err := os.Open(tarballPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var index ociIndex
+	reader := tar.NewReader(f)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(header.Name)
+		switch {
+		case name == ociIndexFile:
+			if err := json.NewDecoder(reader).Decode(&index); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(name, "blobs/") && header.Typeflag == tar.TypeReg:
+			algorithm, hash, _ := strings.Cut(strings.TrimPrefix(name, "blobs/"), "/")
+			digest := algorithm + ":" + hash
+			target, err := blobPath(dir, digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(target); err == nil {
+				// Content-addressed: already there
+				continue
+			}
+			if algorithm != "sha256" {
+				return nil, fmt.Errorf("unsupported digest algorithm for blob %s", digest)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return nil, err
+			}
+			hasher := sha256.New()
+			err = copyFileAtomic(target, io.TeeReader(reader, hasher), func() error {
+				if actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); actual != digest {
+					return fmt.Errorf("blob %s doesn't match its digest, got %s", digest, actual)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("expected one image in the export, found %d", len(index.Manifests))
+	}
+	return &index.Manifests[0], nil
+}
+
+// writeOCITarball writes an OCI layout tarball of the image and the blobs it
+// references.
+func writeOCITarball(w io.Writer, dir string, descriptor ociDescriptor) error {
+	tw := tar.NewWriter(w)
+	addFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	delete(descriptor.Annotations, ociRefAnnotation)
+	index, err := json.Marshal(&ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{descriptor}})
+	if err != nil {
+		return err
+	}
+	if err := addFile(ociLayoutFile, []byte(ociLayoutVersion)); err != nil {
+		return err
+	}
+	if err := addFile(ociIndexFile, index); err != nil {
+		return err
+	}
+
+	written := map[string]bool{}
+	var addBlob func(descriptor ociDescriptor, required bool) error
+	addBlob = func(descriptor ociDescriptor, required bool) error {
+		if written[descriptor.Digest] {
+			return nil
+		}
+		blob, err := blobPath(dir, descriptor.Digest)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(blob)
+		if os.IsNotExist(err) && !required {
+			// Other platforms of an index aren't exported
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		written[descriptor.Digest] = true
+		algorithm, hash, _ := strings.Cut(descriptor.Digest, ":")
+		if err := addFile(path.Join("blobs", algorithm, hash), data); err != nil {
+			return err
+		}
+
+		if !strings.Contains(descriptor.MediaType, "manifest") && !strings.Contains(descriptor.MediaType, "index") {
+			return nil
+		}
+		var manifest ociManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return err
+		}
+		if manifest.Config != nil {
+			if err := addBlob(*manifest.Config, true); err != nil {
+				return err
+			}
+		}
+		for _, layer := range manifest.Layers {
+			if err := addBlob(layer, true); err != nil {
+				return err
+			}
+		}
+		for _, child := range manifest.Manifests {
+			if err := addBlob(child, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := addBlob(descriptor, true); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeFileAtomic writes the file under a temporary name first, so that
+// readers never see it partially written.
+func writeFileAtomic(name string, data []byte) error {
+	return copyFileAtomic(name, bytes.NewReader(data), nil)
+}
+
+// copyFileAtomic is writeFileAtomic streaming the content from r. check, if
+// set, runs once it's all written: the file is discarded if it fails.
+func copyFileAtomic(name string, r io.Reader, check func() error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,69 @@
+package environment
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	TagNetwork        = "network"
+	TagDestructive    = "destructive"
+	TagPackageInstall = "package-install"
+	TagBuild          = "build"
+	TagTest           = "test"
+)
+
+type classifierRule struct {
+	tag     string
+	pattern *regexp.Regexp
+}
+
+var (
+	classifierMu    sync.RWMutex
+	classifierRules = []classifierRule{
+		{TagNetwork, regexp.MustCompile(`\b(curl|wget|ssh|scp|rsync|nc|telnet|ftp|git (clone|fetch|pull|push))\b`)},
+		{TagDestructive, regexp.MustCompile(`\b(rm|rmdir|shred|truncate|dd|mkfs|git (reset --hard|clean))\b|>\s*/`)},
+		{TagPackageInstall, regexp.MustCompile(`\b(apt(-get)?|apk|yum|dnf|brew|pip3?|npm|yarn|pnpm|gem|cargo|go) (install|add|get)\b`)},
+		{TagBuild, regexp.MustCompile(`\b(make|go build|cargo build|npm run build|yarn build|mvn (package|install)|gradle build|docker build|tsc)\b`)},
+		{TagTest, regexp.MustCompile(`\b(go test|pytest|cargo test|npm test|yarn test|jest|mvn test|gradle test|make test)\b`)},
+	}
+)
+
+// RegisterClassifierRule tags the commands matching the regular expression.
+// Rules are added to the builtin ones.
+func RegisterClassifierRule(tag, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid classifier pattern %q: %w", pattern, err)
+	}
+
+	classifierMu.Lock()
+	defer classifierMu.Unlock()
+	classifierRules = append(classifierRules, classifierRule{tag, re})
+	return nil
+}
+
+// ClassifyCommand returns the sorted tags of the rules matching the command.
+func ClassifyCommand(command string) []string {
+	classifierMu.RLock()
+	defer classifierMu.RUnlock()
+
+	tags := []string{}
+	for _, rule := range classifierRules {
+		if rule.pattern.MatchString(command) && !slices.Contains(tags, rule.tag) {
+			tags = append(tags, rule.tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+func tagsNote(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%s]\n", strings.Join(tags, ", "))
+}
@@ -1,9 +1,20 @@
 package environment
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -11,8 +22,20 @@ const (
 	alpineImage      = "alpine:3.21.3@sha256:a8560b36e8b8210634f77d9f7f9efd7ffa463e380b75e2e74aff4511df3ef88c"
 	configDir        = ".container-use"
 	instructionsFile = "AGENT.md"
+	dockerfileFile   = "Dockerfile"
 	environmentFile  = "environment.json"
-	lockFile         = "lock"
+	// exportedConfigFile is the declarative configuration of ExportConfig
+	exportedConfigFile = "env.yaml"
+	lockFile           = "lock"
+	logFile            = "LOG.md"
+
+	// logFileMaxOutput caps each command output in LOG.md
+	logFileMaxOutput = 4 * 1024
+
+	defaultSetupTimeout = 30 * time.Minute
+
+	defaultPullRetries = 3
+	pullRetryBackoff   = 2 * time.Second
 )
 
 func DefaultConfig() *EnvironmentConfig {
@@ -24,22 +47,67 @@ func DefaultConfig() *EnvironmentConfig {
 }
 
 type EnvironmentConfig struct {
-	Instructions  string         `json:"-"`
-	Workdir       string         `json:"workdir,omitempty"`
-	BaseImage     string         `json:"base_image,omitempty"`
-	SetupCommands []string       `json:"setup_commands,omitempty"`
-	Env           []string       `json:"env,omitempty"`
-	Secrets       []string       `json:"secrets,omitempty"`
-	Services      ServiceConfigs `json:"services,omitempty"`
+	Instructions         string            `json:"-" yaml:"instructions,omitempty"`
+	Workdir              string            `json:"workdir,omitempty" yaml:"workdir,omitempty"`
+	BaseImage            string            `json:"base_image,omitempty" yaml:"base_image,omitempty"`
+	Dockerfile           string            `json:"-" yaml:"dockerfile,omitempty"`
+	BuildArgs            []string          `json:"build_args,omitempty" yaml:"build_args,omitempty"`
+	SetupCommands        []string          `json:"setup_commands,omitempty" yaml:"setup_commands,omitempty"`
+	SetupTimeout         int               `json:"setup_timeout,omitempty" yaml:"setup_timeout,omitempty"`
+	SetupCommandTimeouts map[string]int    `json:"setup_command_timeouts,omitempty" yaml:"setup_command_timeouts,omitempty"`
+	Env                  []string          `json:"env,omitempty" yaml:"env,omitempty"`
+	ExpandEnv            bool              `json:"expand_env,omitempty" yaml:"expand_env,omitempty"`
+	Secrets              []string          `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Services             ServiceConfigs    `json:"services,omitempty" yaml:"services,omitempty"`
+	RegistryMirrors      map[string]string `json:"registry_mirrors,omitempty" yaml:"registry_mirrors,omitempty"`
+	DriftIgnore          []string          `json:"drift_ignore,omitempty" yaml:"drift_ignore,omitempty"`
+	SkipNoopRevisions    bool              `json:"skip_noop_revisions,omitempty" yaml:"skip_noop_revisions,omitempty"`
+	Hostname             string            `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	AllowedCommands      []string          `json:"allowed_commands,omitempty" yaml:"allowed_commands,omitempty"`
+	DeniedCommands       []string          `json:"denied_commands,omitempty" yaml:"denied_commands,omitempty"`
+	WriteLog             bool              `json:"write_log,omitempty" yaml:"write_log,omitempty"`
+	// SyncInstructions writes the instructions to AGENT.md at the root of the
+	// source, so that they're committed on the environment branch.
+	SyncInstructions bool `json:"sync_instructions,omitempty" yaml:"sync_instructions,omitempty"`
+	// Umask (e.g. "022") is set before each command, so that the files it
+	// creates have predictable permissions once exported. It only affects the
+	// mode: files are still owned by the user commands run as, the image user.
+	Umask string `json:"umask,omitempty" yaml:"umask,omitempty"`
+	// PathPrepend are directories added in front of PATH, last added first.
+	PathPrepend []string `json:"path_prepend,omitempty" yaml:"path_prepend,omitempty"`
+	// Reproducible sets reproducibleEnv in the environment, before Env so
+	// that it can still be overridden.
+	Reproducible bool `json:"reproducible,omitempty" yaml:"reproducible,omitempty"`
+	// MaxConcurrentExecs bounds the commands running at once in the
+	// environment, queueing the others (default: 4).
+	MaxConcurrentExecs int `json:"max_concurrent_execs,omitempty" yaml:"max_concurrent_execs,omitempty"`
+	// PullRetries is how many times pulling the base image is retried, with
+	// exponential backoff, e.g. when the registry is briefly unavailable
+	// (default: 3, negative to disable).
+	PullRetries int `json:"pull_retries,omitempty" yaml:"pull_retries,omitempty"`
+}
+
+// reproducibleEnv makes builds deterministic:
+//   - SOURCE_DATE_EPOCH=315532800 fixes embedded timestamps to 1980-01-01, the
+//     earliest date zip archives support
+//   - TZ=UTC, LANG=C and LC_ALL=C fix the time zone, the locale and thus
+//     sorting and formatting
+//   - PYTHONHASHSEED=0 disables hash randomization in Python
+var reproducibleEnv = []string{
+	"SOURCE_DATE_EPOCH=315532800",
+	"TZ=UTC",
+	"LANG=C",
+	"LC_ALL=C",
+	"PYTHONHASHSEED=0",
 }
 
 type ServiceConfig struct {
-	Name         string   `json:"name,omitempty"`
-	Image        string   `json:"image,omitempty"`
-	Command      string   `json:"command,omitempty"`
-	ExposedPorts []int    `json:"exposed_ports,omitempty"`
-	Env          []string `json:"env,omitempty"`
-	Secrets      []string `json:"secrets,omitempty"`
+	Name         string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Image        string   `json:"image,omitempty" yaml:"image,omitempty"`
+	Command      string   `json:"command,omitempty" yaml:"command,omitempty"`
+	ExposedPorts []int    `json:"exposed_ports,omitempty" yaml:"exposed_ports,omitempty"`
+	Env          []string `json:"env,omitempty" yaml:"env,omitempty"`
+	Secrets      []string `json:"secrets,omitempty" yaml:"secrets,omitempty"`
 }
 
 type ServiceConfigs []*ServiceConfig
@@ -55,14 +123,104 @@ func (sc ServiceConfigs) Get(name string) *ServiceConfig {
 
 func (config *EnvironmentConfig) Copy() *EnvironmentConfig {
 	copy := *config
+	copy.SetupCommands = slices.Clone(config.SetupCommands)
+	copy.BuildArgs = slices.Clone(config.BuildArgs)
+	copy.SetupCommandTimeouts = maps.Clone(config.SetupCommandTimeouts)
+	copy.RegistryMirrors = maps.Clone(config.RegistryMirrors)
+	copy.Env = slices.Clone(config.Env)
+	copy.Secrets = slices.Clone(config.Secrets)
+	copy.DriftIgnore = slices.Clone(config.DriftIgnore)
+	copy.AllowedCommands = slices.Clone(config.AllowedCommands)
+	copy.DeniedCommands = slices.Clone(config.DeniedCommands)
+	copy.PathPrepend = slices.Clone(config.PathPrepend)
 	copy.Services = make(ServiceConfigs, len(config.Services))
 	for i, svc := range config.Services {
 		svcCopy := *svc
+		svcCopy.ExposedPorts = slices.Clone(svc.ExposedPorts)
+		svcCopy.Env = slices.Clone(svc.Env)
+		svcCopy.Secrets = slices.Clone(svc.Secrets)
 		copy.Services[i] = &svcCopy
 	}
 	return &copy
 }
 
+// setupCommandTimeout returns how long a setup command may run: its entry in
+// SetupCommandTimeouts, or SetupTimeout, both in seconds.
+func (config *EnvironmentConfig) setupCommandTimeout(command string) time.Duration {
+	if timeout, ok := config.SetupCommandTimeouts[command]; ok && timeout > 0 {
+		return time.Duration(timeout) * time.Second
+	}
+	if config.SetupTimeout > 0 {
+		return time.Duration(config.SetupTimeout) * time.Second
+	}
+	return defaultSetupTimeout
+}
+
+func (config *EnvironmentConfig) Validate() error {
+	if config.BaseImage == "" && config.Dockerfile == "" {
+		return errors.New("either a base image or a Dockerfile is required")
+	}
+	if len(config.BuildArgs) > 0 && config.Dockerfile == "" {
+		return errors.New("build args require a Dockerfile")
+	}
+	if err := validateVariables("build arg", config.BuildArgs); err != nil {
+		return err
+	}
+	if !path.IsAbs(config.Workdir) {
+		return fmt.Errorf("workdir must be an absolute path: %q", config.Workdir)
+	}
+	if err := validateVariables("env variable", config.Env); err != nil {
+		return err
+	}
+	if err := validateVariables("secret", config.Secrets); err != nil {
+		return err
+	}
+	if config.Hostname != "" && !hostnameRegexp.MatchString(config.Hostname) {
+		return fmt.Errorf("invalid hostname: %q", config.Hostname)
+	}
+	if config.Umask != "" && !umaskRegexp.MatchString(config.Umask) {
+		return fmt.Errorf("invalid umask: %q, expected an octal mode such as 022", config.Umask)
+	}
+	for _, pattern := range slices.Concat(config.AllowedCommands, config.DeniedCommands) {
+		if _, err := compileCommandPattern(pattern); err != nil {
+			return fmt.Errorf("invalid command pattern %q: %w", pattern, err)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, svc := range config.Services {
+		if svc.Name == "" || svc.Image == "" {
+			return errors.New("services must have a name and an image")
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("service %s is defined more than once", svc.Name)
+		}
+		names[svc.Name] = true
+		if err := validateVariables("env variable", svc.Env); err != nil {
+			return err
+		}
+		if err := validateVariables("secret", svc.Secrets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	hostnameRegexp       = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	umaskRegexp          = regexp.MustCompile(`^0?[0-7]{3}$`)
+	invalidHostnameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+func validateVariables(kind string, variables []string) error {
+	for _, variable := range variables {
+		if k, _, found := strings.Cut(variable, "="); !found || k == "" {
+			return fmt.Errorf("invalid %s: %s", kind, variable)
+		}
+	}
+	return nil
+}
+
 func (config *EnvironmentConfig) Save(baseDir string) error {
 	configPath := path.Join(baseDir, configDir)
 	if err := os.MkdirAll(configPath, 0755); err != nil {
@@ -73,6 +231,14 @@ func (config *EnvironmentConfig) Save(baseDir string) error {
 		return err
 	}
 
+	if config.Dockerfile != "" {
+		if err := os.WriteFile(path.Join(configPath, dockerfileFile), []byte(config.Dockerfile), 0644); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path.Join(configPath, dockerfileFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
@@ -85,9 +251,22 @@ func (config *EnvironmentConfig) Save(baseDir string) error {
 	return nil
 }
 
+// Load loads the configuration from environment.json, AGENT.md and the
+// Dockerfile, or else from an env.yaml written by ExportConfig, e.g. checked in
+// the source.
 func (config *EnvironmentConfig) Load(baseDir string) error {
 	configPath := path.Join(baseDir, configDir)
 
+	if _, err := os.Stat(path.Join(configPath, environmentFile)); errors.Is(err, os.ErrNotExist) {
+		data, err := os.ReadFile(path.Join(configPath, exportedConfigFile))
+		if err == nil {
+			return config.loadExported(data)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
 	instructions, err := os.ReadFile(path.Join(configPath, instructionsFile))
 	if err != nil {
 		return err
@@ -102,6 +281,23 @@ func (config *EnvironmentConfig) Load(baseDir string) error {
 		return err
 	}
 
+	dockerfile, err := os.ReadFile(path.Join(configPath, dockerfileFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	config.Dockerfile = string(dockerfile)
+
+	return nil
+}
+
+// loadExported loads an env.yaml, which has the instructions and the
+// Dockerfile inline.
+func (config *EnvironmentConfig) loadExported(data []byte) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid %s: %w", exportedConfigFile, err)
+	}
 	return nil
 }
 
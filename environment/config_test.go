@@ -0,0 +1,43 @@
+package environment
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExportedConfigRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.BaseImage = ""
+	config.Instructions = "Build with make\nTest with make test\n"
+	config.Dockerfile = "FROM alpine:3.21\nRUN apk add make\n"
+	config.SetupTimeout = 600
+	config.SetupCommandTimeouts = map[string]int{"make deps": 60}
+	config.ExpandEnv = true
+	config.Hostname = "builder"
+	config.Reproducible = true
+	config.Secrets = []string{"API_KEY=env://API_KEY"}
+	config.Services = ServiceConfigs{{Name: "db", Image: "postgres:17", ExposedPorts: []int{5432}}}
+
+	exported, err := (&Environment{Config: config}).ExportConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(worktree, configDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, configDir, exportedConfigFile), exported, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &EnvironmentConfig{}
+	if err := loaded.Load(worktree); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Errorf("expected the exported configuration to load as %+v, got %+v\n%s", config, loaded, exported)
+	}
+}
@@ -0,0 +1,164 @@
+package environment
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultNodeImage   = "node:lts"
+	defaultPythonImage = "python:3.13"
+)
+
+type DetectedBaseImage struct {
+	Image         string   `json:"image"`
+	SetupCommands []string `json:"setup_commands,omitempty"`
+	// Rationale explains which files led to the suggestion.
+	Rationale string `json:"rationale"`
+}
+
+var (
+	goVersionRegexp     = regexp.MustCompile(`(?m)^go\s+(\d+\.\d+)`)
+	nodeVersionRegexp   = regexp.MustCompile(`^v?(\d+)`)
+	pythonVersionRegexp = regexp.MustCompile(`^(\d+\.\d+)`)
+)
+
+// DetectBaseImage suggests a base image and setup commands from the files at
+// the root of the source: the final stage of a Dockerfile, go.mod,
+// package.json or Python project files, in that order. It falls back to the
+// default image when no known stack is found.
+func DetectBaseImage(source string) (*DetectedBaseImage, error) {
+	read := func(name string) (string, bool, error) {
+		data, err := os.ReadFile(filepath.Join(source, name))
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return string(data), err == nil, err
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(source, name))
+		return err == nil
+	}
+
+	dockerfile, found, err := read("Dockerfile")
+	if err != nil {
+		return nil, err
+	}
+	if image := dockerfileBaseImage(dockerfile); found && image != "" {
+		return &DetectedBaseImage{
+			Image:     image,
+			Rationale: fmt.Sprintf("Dockerfile found, using the image of its final stage (%s)", image),
+		}, nil
+	}
+
+	gomod, found, err := read("go.mod")
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		detected := &DetectedBaseImage{
+			Image:         "golang",
+			SetupCommands: []string{"go mod download"},
+			Rationale:     "go.mod found",
+		}
+		if match := goVersionRegexp.FindStringSubmatch(gomod); match != nil {
+			detected.Image = "golang:" + match[1]
+			detected.Rationale += fmt.Sprintf(", requiring go %s", match[1])
+		}
+		return detected, nil
+	}
+
+	if exists("package.json") {
+		detected := &DetectedBaseImage{
+			Image:     defaultNodeImage,
+			Rationale: "package.json found",
+		}
+		for _, name := range []string{".nvmrc", ".node-version"} {
+			version, found, err := read(name)
+			if err != nil {
+				return nil, err
+			}
+			if match := nodeVersionRegexp.FindStringSubmatch(strings.TrimSpace(version)); found && match != nil {
+				detected.Image = "node:" + match[1]
+				detected.Rationale += fmt.Sprintf(", node %s pinned by %s", match[1], name)
+				break
+			}
+		}
+		switch {
+		case exists("pnpm-lock.yaml"):
+			detected.SetupCommands = []string{"corepack enable", "pnpm install --frozen-lockfile"}
+			detected.Rationale += ", installed with pnpm"
+		case exists("yarn.lock"):
+			detected.SetupCommands = []string{"corepack enable", "yarn install --frozen-lockfile"}
+			detected.Rationale += ", installed with yarn"
+		case exists("package-lock.json"):
+			detected.SetupCommands = []string{"npm ci"}
+			detected.Rationale += ", installed with npm"
+		default:
+			detected.SetupCommands = []string{"npm install"}
+		}
+		return detected, nil
+	}
+
+	pythonVersion, hasPythonVersion, err := read(".python-version")
+	if err != nil {
+		return nil, err
+	}
+	if hasPythonVersion || exists("pyproject.toml") || exists("requirements.txt") {
+		detected := &DetectedBaseImage{
+			Image:     defaultPythonImage,
+			Rationale: "Python project found",
+		}
+		if match := pythonVersionRegexp.FindStringSubmatch(strings.TrimSpace(pythonVersion)); match != nil {
+			detected.Image = "python:" + match[1]
+			detected.Rationale += fmt.Sprintf(", python %s pinned by .python-version", match[1])
+		}
+		switch {
+		case exists("requirements.txt"):
+			detected.SetupCommands = []string{"pip install -r requirements.txt"}
+		case exists("pyproject.toml"):
+			detected.SetupCommands = []string{"pip install -e ."}
+		}
+		return detected, nil
+	}
+
+	return &DetectedBaseImage{
+		Image:     defaultImage,
+		Rationale: "no known stack found, using the default image",
+	}, nil
+}
+
+// dockerfileBaseImage returns the image of the final stage, unless it's built
+// from a previous stage, from scratch or from a build argument.
+func dockerfileBaseImage(dockerfile string) string {
+	stages := map[string]bool{}
+	image := ""
+	scanner := bufio.NewScanner(bytes.NewBufferString(dockerfile))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		args := fields[1:]
+		// Skip flags such as --platform
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			continue
+		}
+		image = args[0]
+		if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+			stages[strings.ToLower(args[2])] = true
+		}
+	}
+	if image == "" || image == "scratch" || strings.Contains(image, "$") || stages[strings.ToLower(image)] {
+		return ""
+	}
+	return image
+}
@@ -0,0 +1,206 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+type FileDiff struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	Binary    bool   `json:"binary,omitempty"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Patch     string `json:"patch,omitempty"`
+}
+
+// Diff compares the workdir between two versions of the environment. The
+// format is either "unified" (a patch applicable with `git apply`), "summary"
+// (one line per file with its added and deleted lines) or "json". Comparing a
+// version with itself returns an empty diff.
+func (env *Environment) Diff(ctx context.Context, fromVersion, toVersion int, format string) (string, error) {
+	files, patch, err := env.diffVersions(ctx, fromVersion, toVersion)
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case "", "unified":
+		return patch, nil
+	case "summary":
+		out := &strings.Builder{}
+		for _, file := range files {
+			if file.Binary {
+				fmt.Fprintf(out, "%-8s %s (binary)\n", file.Status, file.Path)
+				continue
+			}
+			fmt.Fprintf(out, "%-8s %s +%d -%d\n", file.Status, file.Path, file.Additions, file.Deletions)
+		}
+		return out.String(), nil
+	case "json":
+		out, err := json.MarshalIndent(files, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	default:
+		return "", fmt.Errorf("unsupported diff format %q, use unified, summary or json", format)
+	}
+}
+
+func (env *Environment) diffVersions(ctx context.Context, fromVersion, toVersion int) ([]*FileDiff, string, error) {
+	from := env.History.Get(fromVersion)
+	if from == nil {
+		return nil, "", fmt.Errorf("version %d not found", fromVersion)
+	}
+	to := env.History.Get(toVersion)
+	if to == nil {
+		return nil, "", fmt.Errorf("version %d not found", toVersion)
+	}
+	if fromVersion == toVersion {
+		return []*FileDiff{}, "", nil
+	}
+
+	return env.diffDirectories(ctx,
+		env.client().LoadContainerFromID(dagger.ContainerID(from.State)).Directory(env.Config.Workdir),
+		env.client().LoadContainerFromID(dagger.ContainerID(to.State)).Directory(env.Config.Workdir),
+	)
+}
+
+// diffDirectories returns the changes from one directory to another, per file
+// and as a unified patch.
+func (env *Environment) diffDirectories(ctx context.Context, from, to *dagger.Directory) ([]*FileDiff, string, error) {
+	container := env.client().Container().
+		From(alpineImage).
+		WithMountedDirectory("/a", from).
+		WithMountedDirectory("/b", to).
+		WithWorkdir("/")
+
+	// diff exits with 1 when there are differences
+	status, err := container.
+		WithExec([]string{"diff", "-rq", "a", "b"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	patch, err := container.
+		WithExec([]string{"diff", "-ruN", "a", "b"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return parseUnifiedDiff(patch, parseDiffStatus(status)), patch, nil
+}
+
+// Divergence is what a fork changed since it was forked.
+type Divergence struct {
+	ParentID string `json:"parent_id"`
+	// ForkVersion is the version of the parent the fork started from.
+	ForkVersion int `json:"fork_version"`
+	// Revisions are the revisions of the fork since then.
+	Revisions []*Revision `json:"revisions"`
+	Files     []*FileDiff `json:"files"`
+	Patch     string      `json:"patch,omitempty"`
+}
+
+// DivergenceFrom compares the workdir of the environment, a fork of parent,
+// with the workdir of parent at the version it was forked from. Changes made
+// to parent since then aren't included: it's what the fork contributed.
+func (env *Environment) DivergenceFrom(ctx context.Context, parent *Environment) (*Divergence, error) {
+	if len(env.History) == 0 || env.History[0].ParentID == "" {
+		return nil, fmt.Errorf("environment %s is not a fork", env.ID)
+	}
+	forkPoint := env.History[0]
+	if forkPoint.ParentID != parent.ID {
+		return nil, fmt.Errorf("environment %s is a fork of %s, not %s", env.ID, forkPoint.ParentID, parent.ID)
+	}
+	base := parent.History.Get(forkPoint.ParentVersion)
+	if base == nil {
+		return nil, fmt.Errorf("version %d of %s, the fork point, not found", forkPoint.ParentVersion, parent.ID)
+	}
+
+	files, patch, err := env.diffDirectories(ctx,
+		env.client().LoadContainerFromID(dagger.ContainerID(base.State)).Directory(parent.Config.Workdir),
+		env.container.Directory(env.Config.Workdir),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Divergence{
+		ParentID:    parent.ID,
+		ForkVersion: base.Version,
+		Revisions:   env.History[1:],
+		Files:       files,
+		Patch:       patch,
+	}, nil
+}
+
+// parseDiffStatus maps the paths only present on one side to their status.
+func parseDiffStatus(output string) map[string]string {
+	statuses := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		dir, name, found := strings.Cut(strings.TrimPrefix(line, "Only in "), ": ")
+		if !found || !strings.HasPrefix(line, "Only in ") {
+			continue
+		}
+		side, rel, _ := strings.Cut(dir, "/")
+		status := "added"
+		if side == "a" {
+			status = "deleted"
+		}
+		statuses[path.Join(rel, name)] = status
+	}
+	return statuses
+}
+
+func parseUnifiedDiff(patch string, statuses map[string]string) []*FileDiff {
+	fileStatus := func(p string) string {
+		for dir := p; dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if status, ok := statuses[dir]; ok {
+				return status
+			}
+		}
+		return "modified"
+	}
+
+	files := []*FileDiff{}
+	var current *FileDiff
+	lines := strings.SplitAfter(patch, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "Binary files "):
+			p, _, _ := strings.Cut(strings.TrimPrefix(line, "Binary files "), " and ")
+			p = strings.TrimPrefix(p, "a/")
+			files = append(files, &FileDiff{Path: p, Status: fileStatus(p), Binary: true})
+			current = nil
+		case strings.HasPrefix(line, "diff "):
+			// Command line preceding the headers of the next file
+			current = nil
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			// A deleted line starting with "-- " looks like a header, but
+			// isn't followed by the new file header.
+			p, _, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(lines[i+1], "+++ ")), "\t")
+			p = strings.TrimPrefix(p, "b/")
+			current = &FileDiff{Path: p, Status: fileStatus(p), Patch: line + lines[i+1]}
+			files = append(files, current)
+			i++
+		case current == nil:
+		case strings.HasPrefix(line, "+"):
+			current.Additions++
+			current.Patch += line
+		case strings.HasPrefix(line, "-"):
+			current.Deletions++
+			current.Patch += line
+		default:
+			current.Patch += line
+		}
+	}
+	return files
+}
@@ -0,0 +1,91 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	driftSourceDir  = "/source"
+	driftCurrentDir = "/current"
+)
+
+// SourceDrift returns the paths of the workdir that changed since the
+// environment was created from the source checkout: modified, added and
+// deleted files. Paths matching one of the configured drift_ignore patterns
+// (e.g. node_modules, *.o) are left out.
+func (env *Environment) SourceDrift(ctx context.Context) ([]string, error) {
+	if len(env.History) == 0 {
+		return nil, errors.New("environment has no history to compare against")
+	}
+	source := env.client().LoadContainerFromID(dagger.ContainerID(env.History[0].State))
+
+	output, err := env.client().Container().
+		From(alpineImage).
+		WithMountedDirectory(driftSourceDir, source.Directory(env.Config.Workdir)).
+		WithMountedDirectory(driftCurrentDir, env.container.Directory(env.Config.Workdir)).
+		WithExec([]string{"diff", "-rq", driftSourceDir, driftCurrentDir}, dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare with the source: %w", err)
+	}
+
+	paths := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		p, ok := parseDiffLine(line)
+		if !ok || env.Config.driftIgnored(p) {
+			continue
+		}
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return slices.Compact(paths), nil
+}
+
+// parseDiffLine extracts the workdir relative path from a `diff -rq` line:
+// "Files /source/a and /current/a differ" or "Only in /current/dir: name".
+func parseDiffLine(line string) (string, bool) {
+	switch {
+	case strings.HasPrefix(line, "Files "):
+		p, _, found := strings.Cut(strings.TrimPrefix(line, "Files "), " and ")
+		if !found {
+			return "", false
+		}
+		return strings.TrimPrefix(p, driftSourceDir+"/"), true
+	case strings.HasPrefix(line, "Only in "):
+		dir, name, found := strings.Cut(strings.TrimPrefix(line, "Only in "), ": ")
+		if !found {
+			return "", false
+		}
+		for _, root := range []string{driftSourceDir, driftCurrentDir} {
+			if dir == root {
+				return name, true
+			}
+			if rel, ok := strings.CutPrefix(dir, root+"/"); ok {
+				return path.Join(rel, name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// driftIgnored reports whether any element of the path matches one of the
+// drift_ignore patterns.
+func (config *EnvironmentConfig) driftIgnored(p string) bool {
+	for _, pattern := range config.DriftIgnore {
+		for _, elem := range strings.Split(p, "/") {
+			if matched, _ := path.Match(pattern, elem); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+const (
+	egressProxyHost = "cu-egress-proxy"
+	egressProxyPort = 8888
+)
+
+// tinyproxy logs the requests it refuses, e.g. `Proxying refused on filtered domain "example.com"`
+var egressDeniedRegexp = regexp.MustCompile(`filtered domain "([^"]+)"`)
+
+func egressLogsVolume(envID string) string {
+	return "container-use-egress-" + strings.ReplaceAll(envID, "/", "-")
+}
+
+// egressFilter converts the allowed hosts to tinyproxy extended regular
+// expressions. "*.example.com" allows example.com and all of its subdomains.
+func egressFilter(allowedHosts []string) (string, error) {
+	filter := &strings.Builder{}
+	for _, host := range allowedHosts {
+		name, wildcard := strings.CutPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "*/: ") {
+			return "", fmt.Errorf("invalid allowed host %q, expected a hostname such as example.com or *.example.com", host)
+		}
+		if wildcard {
+			fmt.Fprintf(filter, "(^|\\.)%s$\n", regexp.QuoteMeta(name))
+			continue
+		}
+		fmt.Fprintf(filter, "^%s$\n", regexp.QuoteMeta(name))
+	}
+	return filter.String(), nil
+}
+
+// withEgressProxy routes the HTTP(S) traffic of the container through a proxy
+// that only lets through the allowed hosts, logging the refused ones to id.log.
+//
+// The engine has no egress controls, so the filtering relies on the clients
+// honoring the http_proxy variables: a client ignoring them, or connecting
+// over another protocol, isn't restricted. Enforcing it for every connection
+// requires the engine to run without direct network access.
+func (env *Environment) withEgressProxy(container *dagger.Container, id string, allowedHosts []string) (*dagger.Container, error) {
+	filter, err := egressFilter(allowedHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	logsDir := "/var/log/cu"
+	config := strings.Join([]string{
+		"User nobody",
+		"Group nobody",
+		fmt.Sprintf("Port %d", egressProxyPort),
+		"Timeout 600",
+		"LogLevel Notice",
+		fmt.Sprintf("LogFile %q", path.Join(logsDir, id+".log")),
+		`Filter "/etc/tinyproxy/filter"`,
+		"FilterExtended On",
+		"FilterDefaultDeny Yes",
+		"ConnectPort 443",
+		"ConnectPort 80",
+	}, "\n") + "\n"
+
+	proxy := env.client().Container().
+		From(alpineImage).
+		WithExec([]string{"apk", "add", "--no-cache", "tinyproxy"}).
+		WithNewFile("/etc/tinyproxy/cu.conf", config).
+		WithNewFile("/etc/tinyproxy/filter", filter).
+		WithMountedCache(logsDir, env.client().CacheVolume(egressLogsVolume(env.ID)), dagger.ContainerWithMountedCacheOpts{
+			Owner: "nobody",
+		}).
+		WithExposedPort(egressProxyPort).
+		AsService(dagger.ContainerAsServiceOpts{
+			Args: []string{"tinyproxy", "-d", "-c", "/etc/tinyproxy/cu.conf"},
+		})
+
+	proxyURL := fmt.Sprintf("http://%s:%d", egressProxyHost, egressProxyPort)
+	container = container.WithServiceBinding(egressProxyHost, proxy)
+	for _, variable := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		container = container.WithEnvVariable(variable, proxyURL)
+	}
+	for _, variable := range []string{"no_proxy", "NO_PROXY"} {
+		container = container.WithoutEnvVariable(variable)
+	}
+	return container, nil
+}
+
+// deniedHosts returns the hosts the proxy refused during the run id.
+func (env *Environment) deniedHosts(ctx context.Context, id string) ([]string, error) {
+	logs, found, err := readLogVolume(ctx, env.client(), egressLogsVolume(env.ID), id+".log")
+	if err != nil || !found {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for _, match := range egressDeniedRegexp.FindAllStringSubmatch(logs, -1) {
+		if !slices.Contains(hosts, match[1]) {
+			hosts = append(hosts, match[1])
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,107 @@
+package environment
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+type EngineStatus struct {
+	// BackgroundServices is the number of services started by RunBackground
+	// that are still tracked by this process.
+	BackgroundServices int `json:"background_services"`
+	// Sessions are the dagger sessions of this process holding services.
+	Sessions          []*SessionStatus `json:"sessions"`
+	CacheEntries      int              `json:"cache_entries"`
+	CacheDiskBytes    int              `json:"cache_disk_bytes"`
+	CacheMaxUsedBytes int              `json:"cache_max_used_bytes"`
+}
+
+// SessionStatus reports what a dagger session of this process keeps running.
+// Services of deleted environments that are still listed have leaked.
+type SessionStatus struct {
+	// Pinned is set for a client given to New, unset for the global one.
+	Pinned             bool     `json:"pinned"`
+	Environments       []string `json:"environments"`
+	BackgroundServices int      `json:"background_services"`
+	Tunnels            int      `json:"tunnels"`
+}
+
+// GetEngineStatus reports the resources held on the engine of the client (the
+// global one if nil): the sessions of this process, their background services
+// and the local cache usage.
+func GetEngineStatus(ctx context.Context, client *dagger.Client) (*EngineStatus, error) {
+	if client == nil {
+		client = dag
+	}
+	cache := client.Engine().LocalCache()
+	entries := cache.EntrySet()
+
+	status := &EngineStatus{}
+	var err error
+	if status.CacheEntries, err = entries.EntryCount(ctx); err != nil {
+		return nil, err
+	}
+	if status.CacheDiskBytes, err = entries.DiskSpaceBytes(ctx); err != nil {
+		return nil, err
+	}
+	if status.CacheMaxUsedBytes, err = cache.MaxUsedSpace(ctx); err != nil {
+		return nil, err
+	}
+
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	sessions := map[*dagger.Client]*SessionStatus{}
+	for _, envID := range slices.Sorted(maps.Keys(backgroundServices)) {
+		for _, service := range backgroundServices[envID] {
+			session, ok := sessions[service.client]
+			if !ok {
+				session = &SessionStatus{Pinned: service.client != dag}
+				sessions[service.client] = session
+				status.Sessions = append(status.Sessions, session)
+			}
+			if !slices.Contains(session.Environments, envID) {
+				session.Environments = append(session.Environments, envID)
+			}
+			session.BackgroundServices++
+			for _, endpoint := range service.Endpoints {
+				if endpoint.tunnel != nil {
+					session.Tunnels++
+				}
+			}
+			status.BackgroundServices++
+		}
+	}
+	return status, nil
+}
+
+// PruneEngine releases the cache entries of the engine of the client (the
+// global one if nil) that are no longer in use. With useDefaultPolicy, the
+// engine keeps what its garbage collection policy allows. The cache is shared
+// with every other user of the engine.
+func PruneEngine(ctx context.Context, client *dagger.Client, useDefaultPolicy bool) error {
+	if client == nil {
+		client = dag
+	}
+	return client.Engine().LocalCache().Prune(ctx, dagger.EngineCachePruneOpts{
+		UseDefaultPolicy: useDefaultPolicy,
+	})
+}
+
+// Shutdown stops the background services and tunnels left running, so that
+// they don't outlive the process. It's meant to be called before closing the
+// dagger client. The engine cache is left alone: it's shared.
+func Shutdown(ctx context.Context) {
+	backgroundMu.Lock()
+	envIDs := slices.Collect(maps.Keys(backgroundServices))
+	backgroundMu.Unlock()
+
+	for _, envID := range envIDs {
+		if err := StopServices(ctx, envID); err != nil {
+			slog.Warn("Failed to stop background services", "environment", envID, "err", err)
+		}
+	}
+}
@@ -2,14 +2,20 @@ package environment
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"dagger.io/dagger"
 )
@@ -21,32 +27,71 @@ func Initialize(client *dagger.Client) error {
 	return nil
 }
 
+// Initialized reports whether Initialize was called, i.e. whether environments
+// can be loaded without a pinned client.
+func Initialized() bool {
+	return dag != nil
+}
+
 type Environment struct {
 	Config *EnvironmentConfig
 
 	ID       string
 	Name     string
 	Worktree string
+	// Source is the host directory the environment was created from, synced
+	// by Watch. Set by the repository.
+	Source string
+
+	// Ephemeral environments only live in memory, without worktree.
+	Ephemeral bool
+
+	// BaseImageDigest is the digest the base image resolved to when the
+	// environment was built, see CheckBaseImageUpdate.
+	BaseImageDigest string
 
 	Services []*Service
 	Notes    Notes
+	History  History
+
+	// RecordNote persists a note right away. Environments are reloaded for
+	// every operation, so it's how background activity outliving the
+	// operation that started it gets recorded. Set by the repository.
+	RecordNote func(ctx context.Context, note string) error
 
 	mu        sync.Mutex
 	container *dagger.Container
+	engine    *dagger.Client
+
+	// detached are the persisted background services, not necessarily running
+	// in this process.
+	detached []*BackgroundService
 }
 
-func New(ctx context.Context, id, name, worktree string) (*Environment, error) {
+// New creates an environment. Its operations run on the given dagger client,
+// or on the global one if nil.
+func New(ctx context.Context, id, name, worktree string, client *dagger.Client) (*Environment, error) {
 	env := &Environment{
 		ID:       id,
 		Name:     name,
 		Worktree: worktree,
 		Config:   DefaultConfig(),
+		engine:   client,
 	}
 
+	var detected *DetectedBaseImage
 	if err := env.Config.Load(worktree); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
+		// Without a configuration, pick the base image from the source. Setup
+		// commands are only suggested: a failing one would fail the creation.
+		if worktree != "" {
+			if detected, err = DetectBaseImage(worktree); err != nil {
+				return nil, err
+			}
+			env.Config.BaseImage = detected.Image
+		}
 	}
 
 	container, err := env.buildBase(ctx)
@@ -59,10 +104,65 @@ func New(ctx context.Context, id, name, worktree string) (*Environment, error) {
 	if err := env.apply(ctx, "Create environment", "Create the environment", "", container); err != nil {
 		return nil, err
 	}
+	if detected != nil {
+		env.Notes.Add("Detected base image %s: %s\n", detected.Image, detected.Rationale)
+		for _, command := range detected.SetupCommands {
+			env.Notes.Add("Suggested setup command: %s\n", command)
+		}
+		env.Notes.Add("\n")
+	}
+
+	return env, nil
+}
+
+// LoadContainer loads a container built elsewhere by its ID, making sure it
+// exists on the engine.
+func LoadContainer(ctx context.Context, client *dagger.Client, id dagger.ContainerID) (*dagger.Container, error) {
+	if client == nil {
+		client = dag
+	}
+	container, err := client.LoadContainerFromID(id).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load container %s: %w", id, err)
+	}
+	return container, nil
+}
+
+// NewFromContainer creates an environment using an existing container as its
+// initial state instead of building the configured base.
+func NewFromContainer(ctx context.Context, id, name, worktree string, container *dagger.Container, client *dagger.Client) (*Environment, error) {
+	env := &Environment{
+		ID:       id,
+		Name:     name,
+		Worktree: worktree,
+		Config:   DefaultConfig(),
+		engine:   client,
+	}
+
+	if err := env.Config.Load(worktree); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	slog.Info("Creating environment from container", "id", env.ID, "name", env.Name, "workdir", env.Config.Workdir)
+
+	if err := env.apply(ctx, "Create environment", "Create the environment from an existing container", "", container); err != nil {
+		return nil, err
+	}
 
 	return env, nil
 }
 
+// client returns the dagger client the environment is pinned to, falling back
+// to the global one.
+func (env *Environment) client() *dagger.Client {
+	if env.engine != nil {
+		return env.engine
+	}
+	return dag
+}
+
 func (env *Environment) Export(ctx context.Context) (rerr error) {
 	_, err := env.container.Directory(env.Config.Workdir).Export(
 		ctx,
@@ -77,6 +177,11 @@ func (env *Environment) Export(ctx context.Context) (rerr error) {
 	if err := env.Config.Save(env.Worktree); err != nil {
 		return err
 	}
+	if env.Config.WriteLog {
+		if err := env.writeLogFile(); err != nil {
+			return err
+		}
+	}
 	return nil
 
 }
@@ -88,7 +193,10 @@ func (env *Environment) State(ctx context.Context) ([]byte, error) {
 	}
 
 	state := &State{
-		Container: string(containerID),
+		Container:       string(containerID),
+		History:         env.History,
+		Services:        env.backgroundRecords(),
+		BaseImageDigest: env.BaseImageDigest,
 	}
 	buff, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
@@ -97,12 +205,13 @@ func (env *Environment) State(ctx context.Context) ([]byte, error) {
 	return buff, nil
 }
 
-func Load(ctx context.Context, id, name string, state []byte, worktree string) (*Environment, error) {
+func Load(ctx context.Context, id, name string, state []byte, worktree string, client *dagger.Client) (*Environment, error) {
 	env := &Environment{
 		ID:       id,
-		Name:     id,
+		Name:     name,
 		Worktree: worktree,
 		Config:   DefaultConfig(),
+		engine:   client,
 	}
 	if err := env.Config.Load(worktree); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
@@ -119,33 +228,84 @@ func Load(ctx context.Context, id, name string, state []byte, worktree string) (
 		}
 	}
 
-	env.container = dag.LoadContainerFromID(dagger.ContainerID(st.Container))
+	env.container = env.client().LoadContainerFromID(dagger.ContainerID(st.Container))
+	env.History = st.History
+	env.detached = st.Services
+	env.BaseImageDigest = st.BaseImageDigest
 
 	return env, nil
 }
 
-func (env *Environment) apply(ctx context.Context, name, explanation, output string, newState *dagger.Container) error {
+func (env *Environment) apply(ctx context.Context, name, explanation, output string, newState *dagger.Container, tags ...string) error {
 	if _, err := newState.Sync(ctx); err != nil {
 		return err
 	}
+	containerID, err := newState.ID(ctx)
+	if err != nil {
+		return err
+	}
 
 	env.mu.Lock()
 	defer env.mu.Unlock()
+
+	// The container ID encodes every operation, including metadata changes
+	// such as env variables, so an identical ID means nothing changed.
+	noop := false
+	if latest := env.History.Latest(); latest != nil && latest.State == string(containerID) {
+		if env.Config.SkipNoopRevisions {
+			return nil
+		}
+		noop = true
+	}
+
+	env.History = append(env.History, &Revision{
+		Version:     env.History.LatestVersion() + 1,
+		Name:        name,
+		Explanation: explanation,
+		Output:      output,
+		CreatedAt:   time.Now(),
+		State:       string(containerID),
+		Noop:        noop,
+		Tags:        tags,
+	})
 	env.container = newState
+	if !noop {
+		env.scheduleReloads(context.WithoutCancel(ctx), newState)
+	}
 
 	return nil
 }
 
-func containerWithEnvAndSecrets(container *dagger.Container, envs, secrets []string) (*dagger.Container, error) {
-	for _, env := range envs {
-		k, v, found := strings.Cut(env, "=")
-		if !found {
-			return nil, fmt.Errorf("invalid env variable: %s", env)
-		}
+// hostname returns the configured hostname, or a stable one derived from the
+// environment name. The engine doesn't support setting the container hostname,
+// so it's only exposed through /etc/hostname and $HOSTNAME.
+func (env *Environment) hostname() string {
+	if env.Config.Hostname != "" {
+		return env.Config.Hostname
+	}
+	name := env.Name
+	if name == "" {
+		name = env.ID
+	}
+	hostname := strings.Trim(invalidHostnameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(hostname) > 63 {
+		hostname = strings.TrimRight(hostname[:63], "-")
+	}
+	return hostname
+}
+
+// containerWithEnvAndSecrets applies env variables and secrets. Values are
+// stored literally unless expand is set, in which case references to variables
+// already defined in the container (e.g. PATH=$PATH:/opt/bin) are expanded.
+func (env *Environment) containerWithEnvAndSecrets(container *dagger.Container, envs, secrets []string, expand bool) (*dagger.Container, error) {
+	for _, variable := range envs {
+		k, v, found := strings.Cut(variable, "=")
 		if !found {
-			return nil, fmt.Errorf("invalid environment variable: %s", env)
+			return nil, fmt.Errorf("invalid env variable: %s", variable)
 		}
-		container = container.WithEnvVariable(k, v)
+		container = container.WithEnvVariable(k, v, dagger.ContainerWithEnvVariableOpts{
+			Expand: expand,
+		})
 	}
 
 	for _, secret := range secrets {
@@ -153,38 +313,130 @@ func containerWithEnvAndSecrets(container *dagger.Container, envs, secrets []str
 		if !found {
 			return nil, fmt.Errorf("invalid secret: %s", secret)
 		}
-		container = container.WithSecretVariable(k, dag.Secret(v))
+		container = container.WithSecretVariable(k, env.client().Secret(v))
 	}
 
 	return container, nil
 }
 
+// pullBaseImage pulls the base image before anything else, retrying on
+// failure, so that a flaky registry is told apart from a failing setup.
+func (env *Environment) pullBaseImage(ctx context.Context, base *dagger.Container) (*dagger.Container, error) {
+	retries := env.Config.PullRetries
+	if retries == 0 {
+		retries = defaultPullRetries
+	}
+
+	backoff := pullRetryBackoff
+	for attempt := 0; ; attempt++ {
+		pulled, err := base.Sync(ctx)
+		if err == nil {
+			return pulled, nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("failed to pull base image %s: %w", env.Config.BaseImage, err)
+		}
+
+		slog.Warn("Failed to pull base image, retrying", "image", env.Config.BaseImage, "attempt", attempt+1, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// baseContainer returns the base image, or the result of the Dockerfile build
+// when one is configured. Build args are passed to the build and are part of
+// its cache key: changing one rebuilds from the first instruction using it.
+func (env *Environment) baseContainer(sourceDir *dagger.Directory) (*dagger.Container, error) {
+	if env.Config.Dockerfile == "" {
+		return env.client().Container().From(env.mirrorImage(env.Config.BaseImage)), nil
+	}
+
+	buildArgs := []dagger.BuildArg{}
+	for _, arg := range env.Config.BuildArgs {
+		k, v, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid build arg: %s", arg)
+		}
+		buildArgs = append(buildArgs, dagger.BuildArg{Name: k, Value: v})
+	}
+
+	dockerfile := path.Join(configDir, dockerfileFile)
+	return sourceDir.
+		WithNewFile(dockerfile, env.mirrorDockerfile(env.Config.Dockerfile)).
+		DockerBuild(dagger.DirectoryDockerBuildOpts{
+			Dockerfile: dockerfile,
+			BuildArgs:  buildArgs,
+		}), nil
+}
+
 func (env *Environment) buildBase(ctx context.Context) (*dagger.Container, error) {
-	sourceDir := dag.Host().Directory(env.Worktree, dagger.HostDirectoryOpts{
+	sourceDir := env.client().Host().Directory(env.Worktree, dagger.HostDirectoryOpts{
 		NoCache: true,
 	})
 
-	container := dag.
-		Container().
-		From(env.Config.BaseImage).
-		WithWorkdir(env.Config.Workdir)
+	container, err := env.baseContainer(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	if env.Config.Dockerfile == "" {
+		if container, err = env.pullBaseImage(ctx, container); err != nil {
+			return nil, err
+		}
+		ref, err := container.ImageRef(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, _, env.BaseImageDigest = parseImageReference(ref)
+	}
+	container = container.
+		WithWorkdir(env.Config.Workdir).
+		WithNewFile("/etc/hostname", env.hostname()+"\n").
+		WithEnvVariable("HOSTNAME", env.hostname())
+	if env.Config.Reproducible {
+		for _, variable := range reproducibleEnv {
+			k, v, _ := strings.Cut(variable, "=")
+			container = container.WithEnvVariable(k, v)
+		}
+	}
 
-	container, err := containerWithEnvAndSecrets(container, env.Config.Env, env.Config.Secrets)
+	container, err = env.containerWithEnvAndSecrets(container, env.Config.Env, env.Config.Secrets, env.Config.ExpandEnv)
 	if err != nil {
 		return nil, err
 	}
+	for _, dir := range env.Config.PathPrepend {
+		container = withPathPrepend(container, dir)
+	}
 
 	for _, command := range env.Config.SetupCommands {
-		var err error
+		if err := env.Config.checkCommandPolicy(command); err != nil {
+			return nil, err
+		}
+		if err := env.intercept(ctx, command); err != nil {
+			return nil, err
+		}
 
 		container = container.WithExec([]string{"sh", "-c", command})
 
-		stdout, err := container.Stdout(ctx)
+		timeout := env.Config.setupCommandTimeout(command)
+		cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+		stdout, err := container.Stdout(cmdCtx)
+		cancel()
 		if err != nil {
+			if errors.Is(cmdCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+				env.Notes.Add("$ %s\ntimed out after %s\n\n", command, timeout)
+				return nil, fmt.Errorf("setup command timed out after %s: %s", timeout, command)
+			}
+
 			var exitErr *dagger.ExecError
 			if errors.As(err, &exitErr) {
-				env.Notes.Add("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n", command, exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
-				return nil, fmt.Errorf("setup command failed with exit code %d.\nstdout: %s\nstderr: %s\n%w\n", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, err)
+				secrets := env.secretValues(ctx, nil)
+				stdout, stderr := redact(exitErr.Stdout, secrets), redact(exitErr.Stderr, secrets)
+				env.Notes.Add("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n", command, exitErr.ExitCode, stdout, stderr)
+				return nil, fmt.Errorf("setup command failed with exit code %d.\nstdout: %s\nstderr: %s\n%w\n", exitErr.ExitCode, stdout, stderr, err)
 			}
 
 			return nil, fmt.Errorf("failed to execute setup command: %w", err)
@@ -207,8 +459,15 @@ func (env *Environment) buildBase(ctx context.Context) (*dagger.Container, error
 }
 
 func (env *Environment) UpdateConfig(ctx context.Context, explanation string, newConfig *EnvironmentConfig) error {
-	if env.Config.Locked(env.Worktree) {
-		return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Worktree, configDir, lockFile))
+	if err := env.checkUnlocked(); err != nil {
+		return err
+	}
+	if env.Ephemeral {
+		return errors.New("ephemeral environments have no source to rebuild from, update the parent and fork it again")
+	}
+
+	if err := newConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	env.Config = newConfig
@@ -218,6 +477,9 @@ func (env *Environment) UpdateConfig(ctx context.Context, explanation string, ne
 	if err != nil {
 		return err
 	}
+	if newConfig.SyncInstructions {
+		container = container.WithNewFile(path.Join(newConfig.Workdir, instructionsFile), newConfig.Instructions)
+	}
 
 	if err := env.apply(ctx, "Update environment", explanation, "", container); err != nil {
 		return err
@@ -226,39 +488,283 @@ func (env *Environment) UpdateConfig(ctx context.Context, explanation string, ne
 	return nil
 }
 
-func (env *Environment) Run(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (string, error) {
-	args := []string{}
-	if command != "" {
-		args = []string{shell, "-c", command}
+// GetConfig returns a copy of the persisted configuration.
+func (env *Environment) GetConfig() EnvironmentConfig {
+	return *env.Config.Copy()
+}
+
+// Description is the runtime status of an environment, beside its
+// configuration.
+type Description struct {
+	Services []*Service `json:"services,omitempty"`
+	// ExecQueue is the backpressure on the commands of the environment, see
+	// EnvironmentConfig.MaxConcurrentExecs.
+	ExecQueue *ExecQueue `json:"exec_queue"`
+}
+
+// Describe reports the runtime status of the environment.
+func (env *Environment) Describe() *Description {
+	return &Description{
+		Services:  env.Services,
+		ExecQueue: env.ExecQueue(),
+	}
+}
+
+// SetConfig replaces the whole configuration at once, rebuilding the environment a single time.
+func (env *Environment) SetConfig(ctx context.Context, explanation string, config EnvironmentConfig) error {
+	return env.UpdateConfig(ctx, explanation, config.Copy())
+}
+
+// PrependPath adds a directory in front of PATH, e.g. after installing tools
+// in a custom prefix. It's kept in the configuration and applied again on
+// rebuilds.
+func (env *Environment) PrependPath(ctx context.Context, explanation, dir string) error {
+	if err := env.checkUnlocked(); err != nil {
+		return err
+	}
+	if !path.IsAbs(dir) {
+		return fmt.Errorf("PATH directories must be absolute: %q", dir)
+	}
+	if _, err := env.container.Directory(dir).Sync(ctx); err != nil {
+		return fmt.Errorf("directory %s not found: %w", dir, err)
 	}
-	newState := env.container.WithExec(args, dagger.ContainerWithExecOpts{
-		UseEntrypoint: useEntrypoint,
+
+	env.Config.PathPrepend = append(slices.DeleteFunc(env.Config.PathPrepend, func(other string) bool {
+		return other == dir
+	}), dir)
+
+	newState := withPathPrepend(env.container, dir)
+	if err := env.apply(ctx, "Prepend "+dir+" to PATH", explanation, "", newState); err != nil {
+		return err
+	}
+
+	env.Notes.Add("Prepend %s to PATH\n%s\n\n", dir, explanation)
+
+	return nil
+}
+
+func withPathPrepend(container *dagger.Container, dir string) *dagger.Container {
+	return container.WithEnvVariable("PATH", dir+":${PATH}", dagger.ContainerWithEnvVariableOpts{
+		Expand: true,
 	})
-	stdout, err := newState.Stdout(ctx)
+}
+
+// dockerfileInstructions are the directives accepted by AppendDockerfile.
+var dockerfileInstructions = []string{
+	"ADD", "ARG", "CMD", "COPY", "ENTRYPOINT", "ENV", "EXPOSE", "HEALTHCHECK", "LABEL",
+	"ONBUILD", "RUN", "SHELL", "STOPSIGNAL", "USER", "VOLUME", "WORKDIR",
+}
+
+// AppendDockerfile adds an instruction (e.g. `RUN apk add curl`) to the end of
+// the Dockerfile and rebuilds the environment.
+func (env *Environment) AppendDockerfile(ctx context.Context, explanation, instruction string) error {
+	if env.Config.Dockerfile == "" {
+		return errors.New("environment is not built from a Dockerfile")
+	}
+	fields := strings.Fields(instruction)
+	if len(fields) < 2 || !slices.Contains(dockerfileInstructions, strings.ToUpper(fields[0])) {
+		return fmt.Errorf("%q is not a Dockerfile instruction, expected one of %s followed by its arguments", instruction, strings.Join(dockerfileInstructions, ", "))
+	}
+
+	config := env.Config.Copy()
+	config.Dockerfile = strings.TrimRight(config.Dockerfile, "\n") + "\n" + strings.TrimSpace(instruction) + "\n"
+	return env.UpdateConfig(ctx, explanation, config)
+}
+
+// InsertSetupCommand inserts a setup command before the one at index (the
+// number of commands to append it) and rebuilds the environment. The engine
+// cache reuses the results of the commands before it.
+func (env *Environment) InsertSetupCommand(ctx context.Context, explanation string, index int, command string) error {
+	if index < 0 || index > len(env.Config.SetupCommands) {
+		return fmt.Errorf("invalid setup command index %d, expected 0 to %d", index, len(env.Config.SetupCommands))
+	}
+	if strings.TrimSpace(command) == "" {
+		return errors.New("empty setup command")
+	}
+
+	config := env.Config.Copy()
+	config.SetupCommands = slices.Insert(config.SetupCommands, index, command)
+	return env.UpdateConfig(ctx, explanation, config)
+}
+
+// RemoveSetupCommand removes the setup command at index and rebuilds the
+// environment.
+func (env *Environment) RemoveSetupCommand(ctx context.Context, explanation string, index int) error {
+	if err := env.checkSetupCommandIndex(index); err != nil {
+		return err
+	}
+
+	config := env.Config.Copy()
+	config.SetupCommands = slices.Delete(config.SetupCommands, index, index+1)
+	return env.UpdateConfig(ctx, explanation, config)
+}
+
+// MoveSetupCommand moves the setup command at from to the index to, shifting
+// the ones in between, and rebuilds the environment.
+func (env *Environment) MoveSetupCommand(ctx context.Context, explanation string, from, to int) error {
+	if err := env.checkSetupCommandIndex(from); err != nil {
+		return err
+	}
+	if err := env.checkSetupCommandIndex(to); err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+
+	config := env.Config.Copy()
+	command := config.SetupCommands[from]
+	config.SetupCommands = slices.Insert(slices.Delete(config.SetupCommands, from, from+1), to, command)
+	return env.UpdateConfig(ctx, explanation, config)
+}
+
+func (env *Environment) checkSetupCommandIndex(index int) error {
+	if index < 0 || index >= len(env.Config.SetupCommands) {
+		return fmt.Errorf("invalid setup command index %d, the environment has %d setup commands", index, len(env.Config.SetupCommands))
+	}
+	return nil
+}
+
+// SetWorkdir changes the directory commands run in. Relative paths are resolved
+// against the current working directory.
+//
+// The source is still exported from Config.Workdir: the new working directory is
+// part of the container state and is reset by the next rebuild.
+func (env *Environment) SetWorkdir(ctx context.Context, explanation, dir string) error {
+	if _, err := env.container.Directory(dir).Sync(ctx); err != nil {
+		return fmt.Errorf("directory %s does not exist in the environment: %w", dir, err)
+	}
+
+	if err := env.apply(ctx, "Set workdir "+dir, explanation, "", env.container.WithWorkdir(dir)); err != nil {
+		return err
+	}
+
+	env.Notes.Add("Set workdir %s\n%s\n\n", dir, explanation)
+
+	return nil
+}
+
+// HasCommand checks whether a command is available in the environment and returns its resolved path.
+// The check is read-only: it neither changes the container state nor records a note.
+func (env *Environment) HasCommand(ctx context.Context, name string) (string, bool, error) {
+	stdout, err := env.container.WithExec([]string{"sh", "-c", `command -v "$1"`, "sh", name}).Stdout(ctx)
 	if err != nil {
 		var exitErr *dagger.ExecError
 		if errors.As(err, &exitErr) {
-			env.Notes.Add("$ %s\nexit %d\nstdout: %s\nstderr: %s\n\n", command, exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
-			return fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr), nil
+			return "", false, nil
 		}
-		return "", err
+		return "", false, err
 	}
-	env.Notes.Add("$ %s\n%s\n\n", command, stdout)
-
-	return stdout, nil
+	return strings.TrimSpace(stdout), true, nil
 }
 
-func (env *Environment) RunBackground(ctx context.Context, explanation, command, shell string, ports []int, useEntrypoint bool) (EndpointMappings, error) {
+func (env *Environment) RunBackground(ctx context.Context, explanation, command, shell string, ports []int, opts RunBackgroundOpts) (*Service, error) {
+	if err := env.Config.checkCommandPolicy(command); err != nil {
+		return nil, err
+	}
+	if err := env.intercept(ctx, command); err != nil {
+		return nil, err
+	}
+	if opts.Name != "" {
+		if _, err := env.FindService(opts.Name); err == nil || env.Config.Services.Get(opts.Name) != nil {
+			return nil, fmt.Errorf("service %s already exists", opts.Name)
+		}
+	}
+
+	if opts.Limits != nil && command == "" {
+		return nil, errors.New("resource limits require a command")
+	}
+	if opts.RestartPolicy != nil && command == "" {
+		return nil, errors.New("a restart policy requires a command, whose exit is monitored")
+	}
+	if opts.RestartOnChange && command == "" {
+		return nil, errors.New("restarting on change requires a command")
+	}
+	if opts.DetectPort && (command == "" || len(ports) > 0) {
+		return nil, errors.New("port detection requires a command and no explicit ports")
+	}
+
+	var readyPattern *regexp.Regexp
+	if opts.WaitForLog != "" {
+		if command == "" {
+			return nil, errors.New("waiting for a log line requires a command")
+		}
+		var err error
+		if readyPattern, err = regexp.Compile(opts.WaitForLog); err != nil {
+			return nil, fmt.Errorf("invalid log pattern: %w", err)
+		}
+	}
+
+	for port, protocol := range opts.Protocols {
+		if protocol != dagger.NetworkProtocolTcp && protocol != dagger.NetworkProtocolUdp {
+			return nil, fmt.Errorf("unsupported protocol %s for port %d", protocol, port)
+		}
+	}
+
+	ports, autoPort, err := allocatePorts(ports)
+	if err != nil {
+		return nil, err
+	}
+	if protocol, ok := opts.Protocols[0]; ok && autoPort != 0 {
+		// Protocols are keyed by the exposed port: the one of port 0 goes to
+		// the allocated one
+		opts.Protocols = maps.Clone(opts.Protocols)
+		delete(opts.Protocols, 0)
+		opts.Protocols[autoPort] = protocol
+	}
+	if err := opts.checkHostPorts(ports); err != nil {
+		return nil, err
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36)
 	args := []string{}
 	if command != "" {
-		args = []string{shell, "-c", command}
+		args = []string{shell, "-c", backgroundScript(id, shell, env.Config.withUmask(command), opts.Limits, opts.MaxLogSize, opts.Stdin != nil)}
+	}
+	serviceState := env.container.WithMountedCache(backgroundLogsDir, env.client().CacheVolume(backgroundLogsVolume(env.ID)))
+	if opts.Stdin != nil {
+		if command == "" {
+			return nil, errors.New("stdin requires a command")
+		}
+		// A secret keeps the content out of the container ID, which is persisted
+		serviceState = serviceState.WithMountedSecret(path.Join(backgroundStdinDir, id), env.commandSecret("stdin-"+id, string(opts.Stdin)), dagger.ContainerWithMountedSecretOpts{
+			Mode: 0o444,
+		})
+	}
+	for _, variable := range opts.Env {
+		k, v, found := strings.Cut(variable, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid env variable: %s", variable)
+		}
+		serviceState = serviceState.WithEnvVariable(k, v)
+	}
+	secretNames := map[string]string{}
+	for k, v := range opts.Secrets {
+		secretNames[k] = env.commandSecretName(k, v)
+		serviceState = serviceState.WithSecretVariable(k, env.commandSecret(k, v))
+	}
+	for mountPath, name := range opts.Volumes {
+		if !path.IsAbs(mountPath) || name == "" {
+			return nil, fmt.Errorf("invalid volume %s=%s: expected an absolute mount path and a name", mountPath, name)
+		}
+		serviceState = serviceState.WithMountedCache(mountPath, env.client().CacheVolume(serviceVolume(env.ID, name)))
+	}
+	for _, name := range opts.DependsOn {
+		dependency, err := env.FindService(name)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s is not running: %w", name, err)
+		}
+		serviceState = serviceState.WithServiceBinding(name, dependency.svc)
+	}
+	if autoPort != 0 {
+		// The command is expected to listen on $PORT
+		serviceState = serviceState.WithEnvVariable("PORT", strconv.Itoa(autoPort))
 	}
-	serviceState := env.container
 
 	// Expose ports
 	for _, port := range ports {
 		serviceState = serviceState.WithExposedPort(port, dagger.ContainerWithExposedPortOpts{
-			Protocol:    dagger.NetworkProtocolTcp,
+			Protocol:    opts.protocol(port),
 			Description: fmt.Sprintf("Port %d", port),
 		})
 	}
@@ -266,55 +772,229 @@ func (env *Environment) RunBackground(ctx context.Context, explanation, command,
 	// Start the service
 	svc, err := serviceState.AsService(dagger.ContainerAsServiceOpts{
 		Args:          args,
-		UseEntrypoint: useEntrypoint,
+		UseEntrypoint: opts.UseEntrypoint,
 	}).Start(ctx)
 	if err != nil {
+		secrets := env.secretValues(ctx, opts.Secrets)
+		starting := &Service{ID: id, envID: env.ID, client: env.client()}
 		var exitErr *dagger.ExecError
 		if errors.As(err, &exitErr) {
-			return nil, fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s", exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr)
+			logs := ""
+			// A daemon that forked leaves its output in the logs only
+			if exitErr.Stdout == "" && exitErr.Stderr == "" {
+				logs = redact(starting.startupLogs(ctx), secrets)
+			}
+			return nil, fmt.Errorf("command failed with exit code %d.\nstdout: %s\nstderr: %s%s", exitErr.ExitCode, redact(exitErr.Stdout, secrets), redact(exitErr.Stderr, secrets), logs)
 		}
+		return nil, fmt.Errorf("%w%s", err, redact(starting.startupLogs(ctx), secrets))
+	}
+
+	env.Notes.Add("$ %s &\n%s\n", redact(command, opts.Secrets), tagsNote(ClassifyCommand(command)))
+
+	endpoints, err := env.exposeService(ctx, svc, ports, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceStateID, err := serviceState.ID(ctx)
+	if err != nil {
 		return nil, err
 	}
 
-	env.Notes.Add("$ %s &\n\n", command)
+	service := &Service{
+		ID: id,
+		Config: &ServiceConfig{
+			Name:         opts.Name,
+			Command:      command,
+			ExposedPorts: ports,
+			Env:          opts.Env,
+		},
+		Endpoints:       endpoints,
+		Limits:          opts.Limits,
+		Volumes:         opts.Volumes,
+		svc:             svc,
+		envID:           env.ID,
+		client:          env.client(),
+		restartOnChange: opts.RestartOnChange,
+		drainTimeout:    opts.DrainTimeout,
+		state:           string(serviceStateID),
+		secrets:         secretNames,
+		stdin:           opts.Stdin != nil,
+		args:            args,
+		entrypoint:      opts.UseEntrypoint,
+	}
 
-	endpoints := EndpointMappings{}
-	for _, port := range ports {
-		endpoint := &EndpointMapping{}
-		endpoints[port] = endpoint
+	if err := service.checkStartup(ctx, opts.StartupGrace); err != nil {
+		if _, stopErr := svc.Stop(ctx); stopErr != nil {
+			slog.Warn("Failed to stop background service", "environment", env.ID, "command", command, "err", stopErr)
+		}
+		env.Notes.Add("$ %s &\n%s\n\n", redact(command, opts.Secrets), redact(err.Error(), opts.Secrets))
+		return nil, err
+	}
 
-		// Expose port on the host
-		tunnel, err := dag.Host().Tunnel(svc, dagger.HostTunnelOpts{
-			Ports: []dagger.PortForward{
-				{
-					Backend:  port,
-					Protocol: dagger.NetworkProtocolTcp,
-				},
-			},
-		}).Start(ctx)
+	if opts.DetectPort {
+		timeout := opts.WaitTimeout
+		if timeout <= 0 {
+			timeout = defaultWaitForLogTimeout
+		}
+		line, err := service.waitForLog(ctx, announcedPortRegexp, timeout)
 		if err != nil {
+			if _, stopErr := svc.Stop(ctx); stopErr != nil {
+				slog.Warn("Failed to stop background service", "environment", env.ID, "command", command, "err", stopErr)
+			}
+			err = fmt.Errorf("no port detected, pass the ports to expose explicitly: %w", err)
+			env.Notes.Add("$ %s &\n%s\n\n", redact(command, opts.Secrets), err)
 			return nil, err
 		}
+		port, _ := strconv.Atoi(announcedPortRegexp.FindStringSubmatch(line)[1])
+		endpoints, err := env.exposeService(ctx, svc, []int{port}, opts)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[port].Detected = true
+		service.Endpoints = endpoints
+		service.Config.ExposedPorts = []int{port}
+		env.Notes.Add("$ %s &\ndetected port %d\n\n", redact(command, opts.Secrets), port)
+	}
 
-		externalEndpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{})
+	if readyPattern != nil {
+		timeout := opts.WaitTimeout
+		if timeout <= 0 {
+			timeout = defaultWaitForLogTimeout
+		}
+		line, err := service.waitForLog(ctx, readyPattern, timeout)
 		if err != nil {
+			if _, stopErr := svc.Stop(ctx); stopErr != nil {
+				slog.Warn("Failed to stop background service", "environment", env.ID, "command", command, "err", stopErr)
+			}
+			env.Notes.Add("$ %s &\nnot ready: %s\n\n", redact(command, opts.Secrets), err)
 			return nil, err
 		}
-		endpoint.External = externalEndpoint
+		service.ReadyLog = line
+	}
 
+	env.trackService(service)
+
+	if opts.RestartPolicy != nil {
+		go env.monitorService(context.WithoutCancel(ctx), service, opts.RestartPolicy)
+	}
+
+	return service, nil
+}
+
+// exposeService returns the endpoints of a background service, tunneling its
+// ports to the host if requested. A failing tunnel doesn't fail the service:
+// the endpoint is reported without an external address.
+func (env *Environment) exposeService(ctx context.Context, svc *dagger.Service, ports []int, opts RunBackgroundOpts) (EndpointMappings, error) {
+	var tlsConfig *tls.Config
+	var certificate string
+	if opts.TLS && opts.ExposeOnHost {
+		var err error
+		if tlsConfig, certificate, err = selfSignedCertificate(); err != nil {
+			return nil, fmt.Errorf("failed to generate a TLS certificate: %w", err)
+		}
+	}
+
+	endpoints := EndpointMappings{}
+	for _, port := range ports {
 		internalEndpoint, err := svc.Endpoint(ctx, dagger.ServiceEndpointOpts{
 			Port: port,
 		})
 		if err != nil {
 			return nil, err
 		}
-		endpoint.Internal = internalEndpoint
+		endpoint := &EndpointMapping{
+			Internal: internalEndpoint,
+		}
+		protocol := opts.protocol(port)
+		if protocol != dagger.NetworkProtocolTcp {
+			endpoint.Protocol = protocol
+		}
+		endpoints[port] = endpoint
+
+		if !opts.ExposeOnHost {
+			continue
+		}
+
+		hostPort := opts.HostPorts[port]
+		if hostPort != 0 && opts.AllowPortReassign {
+			free, err := nextFreeHostPort(hostPort, protocol)
+			if err != nil {
+				return nil, err
+			}
+			if free != hostPort {
+				env.Notes.Add("Host port %d is in use, port %d exposed on %d instead\n\n", hostPort, port, free)
+				endpoint.ReassignedFrom = hostPort
+				hostPort = free
+			}
+		}
+
+		// The proxy only handles TCP
+		countTraffic := (opts.TunnelMetrics || opts.DrainTimeout > 0 || tlsConfig != nil) && protocol == dagger.NetworkProtocolTcp
+		tunnelPort := hostPort
+		if countTraffic {
+			// The proxy listens on the host port instead
+			tunnelPort = 0
+		}
+		tunnel, externalEndpoint, err := env.tunnelToHost(ctx, svc, port, tunnelPort, protocol)
+		if err != nil {
+			slog.Warn("Failed to expose port on the host", "environment", env.ID, "port", port, "err", err)
+			endpoint.Note = fmt.Sprintf("external access unavailable: %s", err)
+			continue
+		}
+		if countTraffic {
+			proxy, err := startCountingProxy(hostPort, externalEndpoint, tlsConfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to proxy port %d: %w", port, err)
+			}
+			endpoint.proxy = proxy
+			externalEndpoint = proxy.endpoint()
+			if tlsConfig != nil {
+				externalEndpoint = "https://" + externalEndpoint
+				endpoint.Certificate = certificate
+			}
+		}
+		endpoint.External = externalEndpoint
+		endpoint.tunnel = tunnel
+		endpoint.HostPortRequested = hostPort != 0 && endpoint.ReassignedFrom == 0
+
+		if opts.ProbeHealth && protocol == dagger.NetworkProtocolTcp {
+			endpoint.Health = probeHealth(ctx, externalEndpoint)
+		}
 	}
 
 	return endpoints, nil
 }
 
-func (env *Environment) Terminal(ctx context.Context) error {
+// tunnelToHost exposes the port of the service on the host port, or a random
+// one if 0.
+func (env *Environment) tunnelToHost(ctx context.Context, svc *dagger.Service, port, hostPort int, protocol dagger.NetworkProtocol) (*dagger.Service, string, error) {
+	tunnel, err := env.client().Host().Tunnel(svc, dagger.HostTunnelOpts{
+		Ports: []dagger.PortForward{
+			{
+				Backend:  port,
+				Frontend: hostPort,
+				Protocol: protocol,
+			},
+		},
+	}).Start(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	endpoint, err := tunnel.Endpoint(ctx, dagger.ServiceEndpointOpts{})
+	if err != nil {
+		return nil, "", err
+	}
+	return tunnel, endpoint, nil
+}
+
+type TerminalOpts struct {
+	// Record captures the input and output of the session with `script` and
+	// adds it to the environment notes.
+	Record bool
+}
+
+func (env *Environment) Terminal(ctx context.Context, opts TerminalOpts) error {
 	container := env.container
 	var cmd []string
 	var sourceRC string
@@ -338,11 +1018,36 @@ func (env *Environment) Terminal(ctx context.Context) error {
 		container = container.WithEnvVariable("ENV", "/cu/rc.sh")
 		cmd = []string{"sh"}
 	}
+
+	var recording string
+	if opts.Record {
+		if _, ok, err := env.HasCommand(ctx, "script"); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("recording a terminal session requires `script` (util-linux) in the environment")
+		}
+		quoted := make([]string, 0, len(cmd))
+		for _, arg := range cmd {
+			quoted = append(quoted, shellQuote(arg))
+		}
+		recording = fmt.Sprintf("terminal-%s.log", strconv.FormatInt(time.Now().UnixNano(), 36))
+		container = container.WithMountedCache(backgroundLogsDir, env.client().CacheVolume(backgroundLogsVolume(env.ID)))
+		cmd = []string{"script", "-q", "-f", "-c", strings.Join(quoted, " "), path.Join(backgroundLogsDir, recording)}
+	}
+
 	if _, err := container.Terminal(dagger.ContainerTerminalOpts{
 		Cmd: cmd,
 	}).Sync(ctx); err != nil {
 		return err
 	}
+
+	if recording != "" {
+		session, _, err := readLogVolume(ctx, env.client(), backgroundLogsVolume(env.ID), recording)
+		if err != nil {
+			return fmt.Errorf("failed to read terminal recording: %w", err)
+		}
+		env.Notes.Add("Terminal session\n%s\n\n", truncate(session))
+	}
 	return nil
 }
 
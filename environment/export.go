@@ -0,0 +1,243 @@
+package environment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"dagger.io/dagger"
+	"gopkg.in/yaml.v3"
+)
+
+// exportedState is a portable representation of an environment: container
+// states are referenced by image digests instead of engine-local IDs.
+type exportedState struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Config       *EnvironmentConfig  `json:"config"`
+	Instructions string              `json:"instructions,omitempty"`
+	Dockerfile   string              `json:"dockerfile,omitempty"`
+	History      []*exportedRevision `json:"history"`
+}
+
+type exportedRevision struct {
+	*Revision
+	Image string `json:"image"`
+}
+
+// ExportState serializes the environment for backup or transfer to another
+// host. Every container state of the history is pushed to the registry (e.g.
+// registry.example.com/backups/env) and referenced by digest.
+func (env *Environment) ExportState(ctx context.Context, registry string) ([]byte, error) {
+	if len(env.History) == 0 {
+		return nil, errors.New("environment has no history to export")
+	}
+
+	exported := &exportedState{
+		ID:           env.ID,
+		Name:         env.Name,
+		Config:       env.Config,
+		Instructions: env.Config.Instructions,
+		Dockerfile:   env.Config.Dockerfile,
+	}
+
+	// Noop revisions share their state with the previous one
+	published := map[string]string{}
+	for _, revision := range env.History {
+		ref, ok := published[revision.State]
+		if !ok {
+			tag := fmt.Sprintf("%s:%s-v%d", registry, strings.ReplaceAll(env.ID, "/", "-"), revision.Version)
+			var err error
+			ref, err = env.client().LoadContainerFromID(dagger.ContainerID(revision.State)).Publish(ctx, tag)
+			if err != nil {
+				return nil, fmt.Errorf("failed to publish version %d: %w", revision.Version, err)
+			}
+			published[revision.State] = ref
+		}
+
+		exportedRev := *revision
+		exportedRev.State = ""
+		exported.History = append(exported.History, &exportedRevision{
+			Revision: &exportedRev,
+			Image:    ref,
+		})
+	}
+
+	return json.MarshalIndent(exported, "", "  ")
+}
+
+// ImportState restores an environment serialized by ExportState, pulling its
+// container states from the registry.
+func ImportState(ctx context.Context, data []byte, worktree string, client *dagger.Client) (*Environment, error) {
+	var exported exportedState
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, fmt.Errorf("failed to parse exported state: %w", err)
+	}
+	if len(exported.History) == 0 || exported.Config == nil {
+		return nil, errors.New("exported state has no history")
+	}
+
+	env := &Environment{
+		ID:       exported.ID,
+		Name:     exported.Name,
+		Worktree: worktree,
+		Config:   exported.Config,
+		engine:   client,
+	}
+	env.Config.Instructions = exported.Instructions
+	env.Config.Dockerfile = exported.Dockerfile
+
+	for _, revision := range exported.History {
+		container, err := env.client().Container().From(revision.Image).Sync(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull version %d: %w", revision.Version, err)
+		}
+		containerID, err := container.ID(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		revision.Revision.State = string(containerID)
+		env.History = append(env.History, revision.Revision)
+		env.container = container
+	}
+
+	return env, nil
+}
+
+// tarballMetadata is written next to a tarball exported by ExportTarball.
+// Only the latest state is in the tarball: the other revisions are kept
+// without their container state.
+type tarballMetadata struct {
+	ID           string             `json:"id"`
+	Name         string             `json:"name"`
+	Config       *EnvironmentConfig `json:"config"`
+	Instructions string             `json:"instructions,omitempty"`
+	Dockerfile   string             `json:"dockerfile,omitempty"`
+	History      History            `json:"history"`
+}
+
+func tarballMetadataPath(tarballPath string) string {
+	return tarballPath + ".json"
+}
+
+// ExportTarball writes the current container state to destPath as an OCI
+// tarball, to move it to a host that doesn't share the engine cache or a
+// registry, and the history to destPath.json to import it back with
+// ImportTarball.
+func (env *Environment) ExportTarball(ctx context.Context, destPath string) error {
+	env.mu.Lock()
+	container := env.container
+	history := History{}
+	for _, revision := range env.History {
+		exportedRev := *revision
+		// Container IDs are only meaningful to the engine that built them
+		exportedRev.State = ""
+		history = append(history, &exportedRev)
+	}
+	env.mu.Unlock()
+	if container == nil {
+		return errors.New("environment has no state to export")
+	}
+
+	if _, err := container.AsTarball().Export(ctx, destPath); err != nil {
+		return fmt.Errorf("failed to export the container: %w", err)
+	}
+
+	data, err := json.MarshalIndent(&tarballMetadata{
+		ID:           env.ID,
+		Name:         env.Name,
+		Config:       env.Config,
+		Instructions: env.Config.Instructions,
+		Dockerfile:   env.Config.Dockerfile,
+		History:      history,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tarballMetadataPath(destPath), data, 0644)
+}
+
+// ImportTarball restores an environment exported by ExportTarball. The latest
+// revision gets the state of the tarball, the previous ones have none and
+// can't be reverted to.
+func ImportTarball(ctx context.Context, srcPath, worktree string, client *dagger.Client) (*Environment, error) {
+	data, err := os.ReadFile(tarballMetadataPath(srcPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tarball metadata: %w", err)
+	}
+	var metadata tarballMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse the tarball metadata: %w", err)
+	}
+	if len(metadata.History) == 0 || metadata.Config == nil {
+		return nil, errors.New("exported tarball has no history")
+	}
+
+	env := &Environment{
+		ID:       metadata.ID,
+		Name:     metadata.Name,
+		Worktree: worktree,
+		Config:   metadata.Config,
+		History:  metadata.History,
+		engine:   client,
+	}
+	env.Config.Instructions = metadata.Instructions
+	env.Config.Dockerfile = metadata.Dockerfile
+
+	absPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	container, err := env.client().Container().Import(env.client().Host().File(absPath)).Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import the container: %w", err)
+	}
+	containerID, err := container.ID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env.History.Latest().State = string(containerID)
+	env.container = container
+
+	return env, nil
+}
+
+// ExportConfig renders the whole configuration as a declarative env.yaml,
+// with the instructions and the Dockerfile inline, e.g. to check in the setup
+// an agent came up with: Load reads it when there's no environment.json. The
+// base image is pinned to its current digest and secrets are only exported as
+// references. The history and running services aren't part of it.
+func (env *Environment) ExportConfig(ctx context.Context) ([]byte, error) {
+	config := env.Config.Copy()
+	if config.Dockerfile != "" {
+		config.BaseImage = ""
+	} else {
+		ref, err := env.client().Container().From(env.mirrorImage(config.BaseImage)).ImageRef(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve base image %s: %w", config.BaseImage, err)
+		}
+		// The digest is the same behind a mirror, keep the original name
+		image, _, _ := strings.Cut(config.BaseImage, "@")
+		if _, digest, ok := strings.Cut(ref, "@"); ok {
+			image += "@" + digest
+		}
+		config.BaseImage = image
+	}
+
+	out := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -3,7 +3,11 @@ package environment
 import (
 	"context"
 	"fmt"
+	"path"
+	"slices"
 	"strings"
+
+	"dagger.io/dagger"
 )
 
 func (s *Environment) FileRead(ctx context.Context, targetFile string, shouldReadEntireFile bool, startLineOneIndexed int, endLineOneIndexedInclusive int) (string, error) {
@@ -64,3 +68,87 @@ func (s *Environment) FileList(ctx context.Context, path string) (string, error)
 	}
 	return out.String(), nil
 }
+
+// Glob returns the paths matching the pattern, which supports ** to match any
+// number of directories (e.g. **/*_test.go). Relative patterns match from the
+// workdir and return relative paths. It doesn't create a revision.
+func (s *Environment) Glob(ctx context.Context, pattern string) ([]string, error) {
+	dir := s.Config.Workdir
+	if path.IsAbs(pattern) {
+		dir = "/"
+	}
+	matches, err := s.container.Directory(dir).Glob(ctx, strings.TrimPrefix(pattern, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if dir == "/" {
+		for i, match := range matches {
+			matches[i] = "/" + match
+		}
+	}
+	slices.Sort(matches)
+	return matches, nil
+}
+
+func (s *Environment) CopyFromImage(ctx context.Context, explanation, image, srcPath, dstPath string) error {
+	source := s.client().Container().From(s.mirrorImage(image))
+
+	var newState *dagger.Container
+	if dir, err := source.Directory(srcPath).Sync(ctx); err == nil {
+		newState = s.container.WithDirectory(dstPath, dir)
+	} else if file, err := source.File(srcPath).Sync(ctx); err == nil {
+		newState = s.container.WithFile(dstPath, file)
+	} else {
+		return fmt.Errorf("%s not found in image %s: %w", srcPath, image, err)
+	}
+
+	if err := s.apply(ctx, fmt.Sprintf("Copy %s from %s", srcPath, image), explanation, "", newState); err != nil {
+		return err
+	}
+
+	s.Notes.Add("Copy %s from %s to %s\n%s\n\n", srcPath, image, dstPath, explanation)
+
+	return nil
+}
+
+// DefaultCleanPatterns are the build artifacts removed by Clean when no
+// patterns are given.
+var DefaultCleanPatterns = []string{
+	"node_modules",
+	"__pycache__",
+	"*.pyc",
+	".pytest_cache",
+	".mypy_cache",
+	"*.o",
+}
+
+// Clean removes the files and directories of the workdir whose name matches
+// one of the patterns, or DefaultCleanPatterns if none are given.
+func (s *Environment) Clean(ctx context.Context, explanation string, patterns []string) error {
+	if len(patterns) == 0 {
+		patterns = DefaultCleanPatterns
+	}
+
+	args := []string{"find", s.Config.Workdir, "-mindepth", "1", "("}
+	for i, pattern := range patterns {
+		if i > 0 {
+			args = append(args, "-o")
+		}
+		args = append(args, "-name", pattern)
+	}
+	args = append(args, ")", "-prune", "-print", "-exec", "rm", "-rf", "{}", "+")
+
+	newState := s.container.WithExec(args)
+	removed, err := newState.Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to clean workdir: %w", err)
+	}
+
+	if err := s.apply(ctx, "Clean "+strings.Join(patterns, " "), explanation, removed, newState); err != nil {
+		return err
+	}
+
+	s.Notes.Add("Clean %s\n%s\n\n", strings.Join(patterns, " "), explanation)
+
+	return nil
+}
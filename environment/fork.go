@@ -0,0 +1,67 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"dagger.io/dagger"
+)
+
+// Fork creates a new environment starting from the given version of this one
+// (0 for the latest), with the same configuration.
+func (env *Environment) Fork(ctx context.Context, id, name, worktree string, version int) (*Environment, error) {
+	revision := env.History.Latest()
+	if version != 0 {
+		revision = env.History.Get(version)
+	}
+	if revision == nil {
+		return nil, fmt.Errorf("version %d not found in environment %s", version, env.ID)
+	}
+
+	fork := &Environment{
+		ID:       id,
+		Name:     name,
+		Worktree: worktree,
+		Config:   env.Config.Copy(),
+		engine:   env.engine,
+	}
+
+	slog.Info("Forking environment", "id", fork.ID, "parent", env.ID, "version", revision.Version)
+
+	container := env.client().LoadContainerFromID(dagger.ContainerID(revision.State))
+	explanation := fmt.Sprintf("Fork from %s (version %d)", env.ID, revision.Version)
+	if err := fork.apply(ctx, "Fork environment", explanation, "", container); err != nil {
+		return nil, err
+	}
+	first := fork.History.Latest()
+	first.ParentID = env.ID
+	first.ParentVersion = revision.Version
+
+	fork.Notes.Add("%s\n\n", explanation)
+
+	return fork, nil
+}
+
+// Clone returns a copy of the environment, without its pending notes, so that
+// an environment kept in memory can be handed to concurrent operations.
+func (env *Environment) Clone() *Environment {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return &Environment{
+		Config:          env.Config.Copy(),
+		ID:              env.ID,
+		Name:            env.Name,
+		Worktree:        env.Worktree,
+		Source:          env.Source,
+		Ephemeral:       env.Ephemeral,
+		BaseImageDigest: env.BaseImageDigest,
+		Services:        slices.Clone(env.Services),
+		History:         slices.Clone(env.History),
+		RecordNote:      env.RecordNote,
+		container:       env.container,
+		engine:          env.engine,
+		detached:        slices.Clone(env.detached),
+	}
+}
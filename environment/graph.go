@@ -0,0 +1,112 @@
+package environment
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type GraphNode struct {
+	// ID is the environment ID and version, e.g. "foo/bar@3".
+	ID          string    `json:"id"`
+	Environment string    `json:"environment"`
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Fork is set for the edge from the revision a fork started from.
+	Fork bool `json:"fork,omitempty"`
+}
+
+type HistoryGraph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+// forkExplanationRegexp finds the parent of forks created before it was
+// recorded in the revision.
+var forkExplanationRegexp = regexp.MustCompile(`^Fork from (\S+) \(version (\d+)\)$`)
+
+func graphNodeID(envID string, version int) string {
+	return fmt.Sprintf("%s@%d", envID, version)
+}
+
+// ExportHistoryGraph renders the revisions of related environments as nodes,
+// linked to the previous revision and, for forks, to the revision they
+// started from. Forks of environments not in envs have no incoming edge. The
+// format is either "json" (nodes and edges) or "dot" (Graphviz).
+func ExportHistoryGraph(envs []*Environment, format string) ([]byte, error) {
+	graph := &HistoryGraph{
+		Nodes: []*GraphNode{},
+		Edges: []*GraphEdge{},
+	}
+	nodes := map[string]bool{}
+	for _, env := range envs {
+		for _, revision := range env.History {
+			id := graphNodeID(env.ID, revision.Version)
+			nodes[id] = true
+			graph.Nodes = append(graph.Nodes, &GraphNode{
+				ID:          id,
+				Environment: env.ID,
+				Version:     revision.Version,
+				Name:        revision.Name,
+				CreatedAt:   revision.CreatedAt,
+			})
+		}
+	}
+	for _, env := range envs {
+		for i, revision := range env.History {
+			id := graphNodeID(env.ID, revision.Version)
+			if i > 0 {
+				graph.Edges = append(graph.Edges, &GraphEdge{
+					From: graphNodeID(env.ID, env.History[i-1].Version),
+					To:   id,
+				})
+				continue
+			}
+
+			parentID, parentVersion := revision.ParentID, revision.ParentVersion
+			if match := forkExplanationRegexp.FindStringSubmatch(revision.Explanation); parentID == "" && match != nil {
+				parentID = match[1]
+				parentVersion, _ = strconv.Atoi(match[2])
+			}
+			if parent := graphNodeID(parentID, parentVersion); parentID != "" && nodes[parent] {
+				graph.Edges = append(graph.Edges, &GraphEdge{From: parent, To: id, Fork: true})
+			}
+		}
+	}
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(graph, "", "  ")
+	case "dot":
+		return graph.dot(), nil
+	default:
+		return nil, fmt.Errorf("unsupported graph format %q, use json or dot", format)
+	}
+}
+
+func (g *HistoryGraph) dot() []byte {
+	out := &strings.Builder{}
+	out.WriteString("digraph history {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, node := range g.Nodes {
+		label := fmt.Sprintf("%s\n%d. %s\n%s", node.Environment, node.Version, node.Name, node.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(out, "\t%s [label=%s];\n", strconv.Quote(node.ID), strconv.Quote(label))
+	}
+	for _, edge := range g.Edges {
+		attrs := ""
+		if edge.Fork {
+			attrs = " [style=dashed, label=\"fork\"]"
+		}
+		fmt.Fprintf(out, "\t%s -> %s%s;\n", strconv.Quote(edge.From), strconv.Quote(edge.To), attrs)
+	}
+	out.WriteString("}\n")
+	return []byte(out.String())
+}
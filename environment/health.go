@@ -0,0 +1,55 @@
+package environment
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const healthProbeTimeout = time.Second
+
+// healthPaths are probed in order, the first one answering wins.
+var healthPaths = []string{"/health", "/healthz", "/"}
+
+type HealthStatus struct {
+	Healthy    bool   `json:"healthy"`
+	Path       string `json:"path,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+}
+
+// probeHealth probes the common health paths of an external endpoint over HTTP.
+func probeHealth(ctx context.Context, endpoint string) *HealthStatus {
+	client := &http.Client{
+		Timeout: healthProbeTimeout,
+		Transport: &http.Transport{
+			// https:// endpoints use our own self-signed certificate
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	for _, path := range healthPaths {
+		target := endpoint + path
+		if !strings.HasPrefix(endpoint, "https://") {
+			target = "http://" + target
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		return &HealthStatus{
+			Healthy:    resp.StatusCode < http.StatusBadRequest,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return &HealthStatus{}
+}
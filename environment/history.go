@@ -0,0 +1,308 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+type Revision struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	Explanation string    `json:"explanation"`
+	Output      string    `json:"output,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	State       string    `json:"state"`
+	// Noop is set when the revision didn't change the container state.
+	Noop bool `json:"noop,omitempty"`
+	// Tags classify the command that created the revision (see ClassifyCommand).
+	Tags []string `json:"tags,omitempty"`
+	// Label is set by the caller to find the revision later (see FindByLabel).
+	Label string `json:"label,omitempty"`
+	// ParentID and ParentVersion record the revision a fork started from, on
+	// the first revision of the fork.
+	ParentID      string `json:"parent_id,omitempty"`
+	ParentVersion int    `json:"parent_version,omitempty"`
+}
+
+type History []*Revision
+
+func (h History) Latest() *Revision {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[len(h)-1]
+}
+
+func (h History) LatestVersion() int {
+	latest := h.Latest()
+	if latest == nil {
+		return 0
+	}
+	return latest.Version
+}
+
+func (h History) Get(version int) *Revision {
+	for _, revision := range h {
+		if revision.Version == version {
+			return revision
+		}
+	}
+	return nil
+}
+
+// FindByLabel returns the revisions with the label, oldest first.
+func (h History) FindByLabel(label string) []*Revision {
+	revisions := []*Revision{}
+	for _, revision := range h {
+		if revision.Label == label {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions
+}
+
+type VerificationError struct {
+	Version int    `json:"version"`
+	Message string `json:"message"`
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("version %d: %s", e.Version, e.Message)
+}
+
+// VerifyHistory loads the container of every revision and reports the ones
+// that can't be recovered anymore, e.g. after the engine cache was pruned, so
+// that reverting to them would fail. It checks every revision rather than
+// stopping at the first problem, and only fails if ctx is done.
+func (env *Environment) VerifyHistory(ctx context.Context) ([]*VerificationError, error) {
+	env.mu.Lock()
+	history := slices.Clone(env.History)
+	env.mu.Unlock()
+
+	problems := []*VerificationError{}
+	for _, revision := range history {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if revision.State == "" {
+			problems = append(problems, &VerificationError{Version: revision.Version, Message: "no container recorded"})
+			continue
+		}
+		container, err := LoadContainer(ctx, env.client(), dagger.ContainerID(revision.State))
+		if err != nil {
+			problems = append(problems, &VerificationError{Version: revision.Version, Message: err.Error()})
+			continue
+		}
+		id, err := container.ID(ctx)
+		if err != nil {
+			problems = append(problems, &VerificationError{Version: revision.Version, Message: err.Error()})
+			continue
+		}
+		if string(id) != revision.State {
+			problems = append(problems, &VerificationError{Version: revision.Version, Message: "loaded container doesn't match the recorded one"})
+		}
+	}
+	return problems, nil
+}
+
+type HistoryPage struct {
+	Revisions []*Revision `json:"revisions"`
+	Total     int         `json:"total"`
+	// NextOffset is the offset of the next page, 0 on the last page.
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// HistoryPage returns up to limit revisions ordered by version, starting at offset.
+func (env *Environment) HistoryPage(offset, limit int) (*HistoryPage, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("invalid page: offset %d, limit %d", offset, limit)
+	}
+
+	env.mu.Lock()
+	revisions := slices.SortedFunc(slices.Values(env.History), func(a, b *Revision) int {
+		return a.Version - b.Version
+	})
+	env.mu.Unlock()
+
+	page := &HistoryPage{
+		Revisions: []*Revision{},
+		Total:     len(revisions),
+	}
+	if offset >= len(revisions) {
+		return page, nil
+	}
+	end := min(offset+limit, len(revisions))
+	page.Revisions = revisions[offset:end]
+	if end < len(revisions) {
+		page.NextOffset = end
+	}
+	return page, nil
+}
+
+type logEntry struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	Explanation string    `json:"explanation,omitempty"`
+	Output      string    `json:"output,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Noop        bool      `json:"noop,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Label       string    `json:"label,omitempty"`
+}
+
+// NotesRef is the git notes ref the notes of the environment are recorded
+// under, on the commits of its branch.
+const NotesRef = "container-use"
+
+type logNote struct {
+	// Commit is empty for the notes not recorded yet.
+	Commit    string    `json:"commit,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Note      string    `json:"note"`
+}
+
+type logReport struct {
+	ID        string             `json:"id"`
+	Name      string             `json:"name"`
+	Config    *EnvironmentConfig `json:"config"`
+	Revisions []*logEntry        `json:"revisions"`
+	Notes     []*logNote         `json:"notes,omitempty"`
+}
+
+// ExportLog renders every operation recorded in the environment history and
+// the notes recorded in git, either as JSON ("json") for tools or as Markdown
+// ("markdown") for humans.
+func (env *Environment) ExportLog(ctx context.Context, format string) ([]byte, error) {
+	report := env.logReport()
+	notes, err := env.gitNotes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the notes: %w", err)
+	}
+	report.Notes = notes
+
+	switch format {
+	case "json":
+		return json.MarshalIndent(report, "", "  ")
+	case "markdown", "md":
+		return report.markdown(0), nil
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, use json or markdown", format)
+	}
+}
+
+func (env *Environment) logReport() *logReport {
+	report := &logReport{
+		ID:     env.ID,
+		Name:   env.Name,
+		Config: env.Config,
+	}
+	for _, revision := range env.History {
+		report.Revisions = append(report.Revisions, &logEntry{
+			Version:     revision.Version,
+			Name:        revision.Name,
+			Explanation: revision.Explanation,
+			Output:      revision.Output,
+			CreatedAt:   revision.CreatedAt,
+			Noop:        revision.Noop,
+			Tags:        revision.Tags,
+			Label:       revision.Label,
+		})
+	}
+	return report
+}
+
+// gitNotes returns the notes of the commits of the worktree, oldest first,
+// followed by the ones not recorded yet.
+func (env *Environment) gitNotes(ctx context.Context) ([]*logNote, error) {
+	notes := []*logNote{}
+	if env.Worktree != "" {
+		cmd := exec.CommandContext(ctx, "git", "log", "--reverse", "--notes="+NotesRef, "--format=%H%x1f%cI%x1f%N%x1e")
+		cmd.Dir = env.Worktree
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range strings.Split(string(out), "\x1e") {
+			fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x1f", 3)
+			if len(fields) != 3 || strings.TrimSpace(fields[2]) == "" {
+				continue
+			}
+			createdAt, err := time.Parse(time.RFC3339, fields[1])
+			if err != nil {
+				return nil, err
+			}
+			notes = append(notes, &logNote{
+				Commit:    fields[0],
+				CreatedAt: createdAt,
+				Note:      strings.TrimSpace(fields[2]),
+			})
+		}
+	}
+	if pending := strings.TrimSpace(env.Notes.String()); pending != "" {
+		notes = append(notes, &logNote{CreatedAt: time.Now(), Note: pending})
+	}
+	return notes, nil
+}
+
+// writeLogFile materializes the log in the worktree so that it can be browsed
+// from the environment branch.
+func (env *Environment) writeLogFile() error {
+	return os.WriteFile(path.Join(env.Worktree, configDir, logFile), env.logReport().markdown(logFileMaxOutput), 0644)
+}
+
+// markdown renders the report, keeping the end of outputs longer than
+// maxOutput bytes if set.
+func (r *logReport) markdown(maxOutput int) []byte {
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "# Environment %s\n\n", r.ID)
+	fmt.Fprintf(out, "- Base image: `%s`\n", r.Config.BaseImage)
+	fmt.Fprintf(out, "- Workdir: `%s`\n", r.Config.Workdir)
+	for _, command := range r.Config.SetupCommands {
+		fmt.Fprintf(out, "- Setup: `%s`\n", command)
+	}
+
+	for _, entry := range r.Revisions {
+		fmt.Fprintf(out, "\n## %d. %s\n\n", entry.Version, entry.Name)
+		if entry.Noop {
+			fmt.Fprintf(out, "_no changes_\n")
+		}
+		if len(entry.Tags) > 0 {
+			fmt.Fprintf(out, "Tags: %s\n", strings.Join(entry.Tags, ", "))
+		}
+		if entry.Label != "" {
+			fmt.Fprintf(out, "Label: %s\n", entry.Label)
+		}
+		fmt.Fprintf(out, "_%s_\n", entry.CreatedAt.Format(time.RFC3339))
+		if entry.Explanation != "" {
+			fmt.Fprintf(out, "\n%s\n", entry.Explanation)
+		}
+		if entry.Output != "" {
+			output := entry.Output
+			if maxOutput > 0 && len(output) > maxOutput {
+				output = fmt.Sprintf("[%d bytes truncated]\n%s", len(output)-maxOutput, output[len(output)-maxOutput:])
+			}
+			fmt.Fprintf(out, "\n```\n%s\n```\n", strings.TrimRight(output, "\n"))
+		}
+	}
+
+	if len(r.Notes) > 0 {
+		fmt.Fprintf(out, "\n## Notes\n")
+	}
+	for _, note := range r.Notes {
+		commit := "not recorded yet"
+		if note.Commit != "" {
+			commit = note.Commit[:min(len(note.Commit), 12)]
+		}
+		fmt.Fprintf(out, "\n### %s\n\n_%s_\n\n```\n%s\n```\n", commit, note.CreatedAt.Format(time.RFC3339), note.Note)
+	}
+	return []byte(out.String())
+}
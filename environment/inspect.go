@@ -0,0 +1,70 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type BuildStep struct {
+	Instruction string `json:"instruction"`
+	Value       string `json:"value"`
+}
+
+type BuildPlan struct {
+	Steps []BuildStep `json:"steps"`
+}
+
+func (p *BuildPlan) add(instruction, format string, a ...any) {
+	p.Steps = append(p.Steps, BuildStep{
+		Instruction: instruction,
+		Value:       fmt.Sprintf(format, a...),
+	})
+}
+
+// String renders the plan in a Dockerfile-like format.
+func (p *BuildPlan) String() string {
+	out := &strings.Builder{}
+	for _, step := range p.Steps {
+		fmt.Fprintf(out, "%s %s\n", step.Instruction, step.Value)
+	}
+	return out.String()
+}
+
+// Inspect returns the ordered steps the environment is built from, following
+// buildBase. The base image is resolved to its digest.
+func (env *Environment) Inspect(ctx context.Context) (*BuildPlan, error) {
+	plan := &BuildPlan{}
+
+	if env.Config.Dockerfile != "" {
+		plan.add("BUILD", "%s/%s", configDir, dockerfileFile)
+		for _, arg := range env.Config.BuildArgs {
+			plan.add("ARG", "%s", arg)
+		}
+	} else {
+		ref, err := env.client().Container().From(env.mirrorImage(env.Config.BaseImage)).ImageRef(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve base image %s: %w", env.Config.BaseImage, err)
+		}
+		plan.add("FROM", "%s", ref)
+	}
+
+	plan.add("WORKDIR", "%s", env.Config.Workdir)
+	plan.add("HOSTNAME", "%s", env.hostname())
+	for _, variable := range env.Config.Env {
+		plan.add("ENV", "%s", variable)
+	}
+	for _, secret := range env.Config.Secrets {
+		// Only the secret name and reference, never the value
+		plan.add("SECRET", "%s", secret)
+	}
+	for _, command := range env.Config.SetupCommands {
+		plan.add("RUN", "%s", command)
+	}
+	for _, service := range env.Config.Services {
+		plan.add("SERVICE", "%s=%s", service.Name, service.Image)
+	}
+	plan.add("COPY", "%s %s", env.Worktree, env.Config.Workdir)
+
+	return plan, nil
+}
@@ -0,0 +1,37 @@
+package environment
+
+import (
+	"context"
+	"sync"
+)
+
+// RunInterceptor is called before a command runs in an environment (Run,
+// RunBackground and setup commands). Returning an error aborts the command
+// with that error.
+type RunInterceptor func(ctx context.Context, env *Environment, command string) error
+
+var (
+	interceptorsMu  sync.RWMutex
+	runInterceptors []RunInterceptor
+)
+
+// RegisterRunInterceptor adds an interceptor to the chain. Interceptors are
+// called in registration order and the first error stops the chain.
+func RegisterRunInterceptor(interceptor RunInterceptor) {
+	interceptorsMu.Lock()
+	defer interceptorsMu.Unlock()
+
+	runInterceptors = append(runInterceptors, interceptor)
+}
+
+func (env *Environment) intercept(ctx context.Context, command string) error {
+	interceptorsMu.RLock()
+	defer interceptorsMu.RUnlock()
+
+	for _, interceptor := range runInterceptors {
+		if err := interceptor(ctx, env, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package environment
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMaxConcurrentExecs is low since the commands of an environment share
+// its state and usually compete for the same resources.
+const defaultMaxConcurrentExecs = 4
+
+// execLimiter queues the commands of an environment past its limit. The limit
+// can change while commands run or wait: they're all accounted for in the
+// same limiter.
+type execLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	queued  int
+	// released is closed, and replaced, when a slot may have become free
+	released chan struct{}
+}
+
+// Environments are reloaded for every operation, so limiters are kept per
+// environment ID for the lifetime of the process.
+var (
+	execLimitersMu sync.Mutex
+	execLimiters   = map[string]*execLimiter{}
+)
+
+func (env *Environment) execLimiter() *execLimiter {
+	limit := env.Config.MaxConcurrentExecs
+	if limit <= 0 {
+		limit = defaultMaxConcurrentExecs
+	}
+
+	execLimitersMu.Lock()
+	defer execLimitersMu.Unlock()
+	limiter, ok := execLimiters[env.ID]
+	if !ok {
+		limiter = &execLimiter{released: make(chan struct{})}
+		execLimiters[env.ID] = limiter
+	}
+	limiter.setLimit(limit)
+	return limiter
+}
+
+// setLimit changes the limit. Commands already running above a lowered limit
+// complete, and the queued ones wait for the count to get under it.
+func (l *execLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > l.limit {
+		l.wake()
+	}
+	l.limit = limit
+}
+
+// wake lets the queued commands check for a free slot. l.mu must be held.
+func (l *execLimiter) wake() {
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// acquire waits for a slot and returns the function releasing it.
+func (l *execLimiter) acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	l.queued++
+	for l.running >= l.limit {
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.queued--
+			l.mu.Unlock()
+			return nil, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.queued--
+	l.running++
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.running--
+		l.wake()
+	}, nil
+}
+
+type ExecQueue struct {
+	Limit   int `json:"limit"`
+	Running int `json:"running"`
+	// Queued commands wait for a running one to complete.
+	Queued int `json:"queued"`
+}
+
+// ExecQueue reports the commands of the environment running and waiting for
+// their turn.
+func (env *Environment) ExecQueue() *ExecQueue {
+	limiter := env.execLimiter()
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	return &ExecQueue{
+		Limit:   limiter.limit,
+		Running: limiter.running,
+		Queued:  limiter.queued,
+	}
+}
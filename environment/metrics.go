@@ -0,0 +1,143 @@
+package environment
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TunnelMetrics struct {
+	Connections int64 `json:"connections"`
+	// BytesIn were sent by clients to the service, BytesOut sent back.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// countingProxy sits in front of a host tunnel to count its traffic and
+// track its connections, since the engine doesn't report any.
+type countingProxy struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	backend string
+
+	connections atomic.Int64
+	active      sync.WaitGroup
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+}
+
+// startCountingProxy listens on the host port (0 for a random one) and
+// forwards connections to the tunnel endpoint, terminating TLS if configured.
+func startCountingProxy(hostPort int, backend string, tlsConfig *tls.Config) (*countingProxy, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", hostPort))
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	proxy := &countingProxy{
+		listener: listener,
+		backend:  backend,
+	}
+	// serve counts as active until the listener is closed, so that the
+	// connections it accepts are added before wait can return
+	proxy.active.Add(1)
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (p *countingProxy) endpoint() string {
+	return fmt.Sprintf("localhost:%d", p.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (p *countingProxy) setBackend(backend string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.backend = backend
+}
+
+func (p *countingProxy) metrics() *TunnelMetrics {
+	return &TunnelMetrics{
+		Connections: p.connections.Load(),
+		BytesIn:     p.bytesIn.Load(),
+		BytesOut:    p.bytesOut.Load(),
+	}
+}
+
+func (p *countingProxy) Close() error {
+	return p.listener.Close()
+}
+
+// wait waits for the connections in flight to complete, up to the timeout,
+// and reports whether they did. New ones must be refused first with Close.
+func (p *countingProxy) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *countingProxy) serve() {
+	defer p.active.Done()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			// Closed
+			return
+		}
+		p.connections.Add(1)
+		p.active.Add(1)
+		go func() {
+			defer p.active.Done()
+			p.forward(conn)
+		}()
+	}
+}
+
+func (p *countingProxy) forward(conn net.Conn) {
+	defer conn.Close()
+
+	p.mu.Lock()
+	backend := p.backend
+	p.mu.Unlock()
+	upstream, err := net.Dial("tcp", backend)
+	if err != nil {
+		slog.Warn("Failed to reach tunnel", "backend", backend, "err", err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(upstream, conn)
+		p.bytesIn.Add(n)
+		// Let the service see the end of the request
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	n, _ := io.Copy(conn, upstream)
+	p.bytesOut.Add(n)
+	switch client := conn.(type) {
+	case *net.TCPConn:
+		client.CloseWrite()
+	case *tls.Conn:
+		client.CloseWrite()
+	}
+	<-done
+}
@@ -0,0 +1,91 @@
+package environment
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultRegistry = "docker.io"
+
+// Global registry mirrors, keyed by registry host (e.g. "docker.io" => "mirror.gcr.io").
+// Mirrors from the environment configuration take precedence.
+var registryMirrors = map[string]string{}
+
+func SetRegistryMirrors(mirrors map[string]string) {
+	registryMirrors = mirrors
+}
+
+// ParseRegistryMirrors parses a comma separated list of registry=mirror pairs.
+func ParseRegistryMirrors(spec string) (map[string]string, error) {
+	mirrors := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		registry, mirror, found := strings.Cut(pair, "=")
+		if !found || registry == "" || mirror == "" {
+			return nil, fmt.Errorf("invalid registry mirror: %s", pair)
+		}
+		mirrors[registry] = mirror
+	}
+	return mirrors, nil
+}
+
+// mirrorImage rewrites an image reference to pull it through the configured
+// mirror of its registry. Tags and digests are kept as is: references pinned by
+// digest are rewritten too, and the digest guarantees the mirror serves the
+// exact same image.
+func (env *Environment) mirrorImage(image string) string {
+	registry, repository := splitImageRegistry(image)
+
+	mirror, ok := env.Config.RegistryMirrors[registry]
+	if !ok {
+		mirror, ok = registryMirrors[registry]
+	}
+	if !ok {
+		return image
+	}
+	return mirror + "/" + repository
+}
+
+func splitImageRegistry(image string) (string, string) {
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return first, rest
+	}
+	if !found {
+		// Official images live under library/
+		return defaultRegistry, "library/" + image
+	}
+	return defaultRegistry, image
+}
+
+// mirrorDockerfile rewrites the images of FROM instructions, leaving references
+// to previous build stages untouched.
+func (env *Environment) mirrorDockerfile(dockerfile string) string {
+	stages := map[string]bool{}
+	lines := strings.Split(dockerfile, "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		image := 1
+		for image < len(fields) && strings.HasPrefix(fields[image], "--") {
+			image++
+		}
+		if image >= len(fields) {
+			continue
+		}
+		if !stages[strings.ToLower(fields[image])] && !strings.Contains(fields[image], "$") && fields[image] != "scratch" {
+			fields[image] = env.mirrorImage(fields[image])
+			lines[i] = strings.Join(fields, " ")
+		}
+		if len(fields) > image+2 && strings.EqualFold(fields[image+1], "AS") {
+			stages[strings.ToLower(fields[image+2])] = true
+		}
+	}
+	return strings.Join(lines, "\n")
+}
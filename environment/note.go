@@ -1,7 +1,9 @@
 package environment
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"strings"
 	"sync"
 )
@@ -41,3 +43,17 @@ func (n *Notes) Pop() string {
 
 	return out
 }
+
+// backgroundNote records a note about background activity, such as a service
+// restart, which happens after the operation that started it returned and had
+// its notes recorded. It goes through RecordNote, or waits for the notes of
+// the next operation on this environment without it.
+func (env *Environment) backgroundNote(ctx context.Context, format string, a ...any) {
+	if env.RecordNote == nil {
+		env.Notes.Add(format, a...)
+		return
+	}
+	if err := env.RecordNote(ctx, fmt.Sprintf(format, a...)); err != nil {
+		slog.Warn("Failed to record background note", "environment", env.ID, "err", err)
+	}
+}
@@ -0,0 +1,132 @@
+package environment
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PolicyViolationError is returned when a command is rejected by the allowed
+// and denied commands of the environment.
+type PolicyViolationError struct {
+	Command string
+	Reason  string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return fmt.Sprintf("policy violation: %q %s", e.Command, e.Reason)
+}
+
+// compileCommandPattern compiles a command pattern: regular expressions are
+// prefixed with "re:", anything else is a glob where * matches any sequence of
+// characters and ? a single one. Both must match the whole command.
+func compileCommandPattern(pattern string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+		return regexp.Compile("^(?:" + expr + ")$")
+	}
+
+	expr := &strings.Builder{}
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func matchCommandPatterns(patterns []string, command string) (string, error) {
+	for _, pattern := range patterns {
+		re, err := compileCommandPattern(pattern)
+		if err != nil {
+			return "", fmt.Errorf("invalid command pattern %q: %w", pattern, err)
+		}
+		if re.MatchString(command) {
+			return pattern, nil
+		}
+	}
+	return "", nil
+}
+
+// splitCommand returns the commands a shell command line runs: it's split on
+// ;, &, &&, |, ||, newlines, subshells and command substitutions. Quotes are
+// ignored, so a quoted separator splits the command too, which can only make
+// the policy stricter.
+func splitCommand(command string) []string {
+	commands := []string{}
+	start := 0
+	for i := 0; i < len(command); i++ {
+		switch command[i] {
+		case ';', '|', '\n', '`', '(', ')':
+		case '&':
+			// Redirections such as 2>&1 and &>file don't run a command
+			if i > 0 && (command[i-1] == '>' || command[i-1] == '<') || i+1 < len(command) && command[i+1] == '>' {
+				continue
+			}
+		default:
+			continue
+		}
+		part := command[start:i]
+		if command[i] == '(' {
+			part = strings.TrimSuffix(part, "$")
+		}
+		commands = append(commands, part)
+		start = i + 1
+	}
+	commands = append(commands, command[start:])
+	return slices.DeleteFunc(commands, func(part string) bool {
+		return strings.TrimSpace(part) == ""
+	})
+}
+
+// checkCommandPolicy enforces the allowed and denied commands of the
+// configuration on every command of the command line (see splitCommand), so
+// that "npm *" doesn't allow "npm test; curl ... | sh". Denied patterns take
+// precedence, and are also matched against the whole command line.
+func (config *EnvironmentConfig) checkCommandPolicy(command string) error {
+	command = strings.TrimSpace(command)
+	if len(config.AllowedCommands) == 0 && len(config.DeniedCommands) == 0 {
+		return nil
+	}
+	parts := splitCommand(command)
+	if len(parts) == 0 {
+		parts = []string{command}
+	}
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+
+	for _, part := range append([]string{command}, parts...) {
+		denied, err := matchCommandPatterns(config.DeniedCommands, part)
+		if err != nil {
+			return err
+		}
+		if denied != "" {
+			return &PolicyViolationError{Command: command, Reason: fmt.Sprintf("is denied by %q", denied)}
+		}
+	}
+
+	if len(config.AllowedCommands) == 0 {
+		return nil
+	}
+	for _, part := range parts {
+		allowed, err := matchCommandPatterns(config.AllowedCommands, part)
+		if err != nil {
+			return err
+		}
+		if allowed == "" {
+			if part == command {
+				return &PolicyViolationError{Command: command, Reason: "is not allowed in this environment"}
+			}
+			return &PolicyViolationError{Command: command, Reason: fmt.Sprintf("runs %q, which is not allowed in this environment", part)}
+		}
+	}
+	return nil
+}
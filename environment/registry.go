@@ -0,0 +1,193 @@
+package environment
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	registryCacheTTL  = time.Hour
+	maxNewerImageTags = 10
+	registryTimeout   = 30 * time.Second
+)
+
+type ImageUpdate struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag,omitempty"`
+	// NewerTags have a higher version than the tag in the same format (e.g.
+	// 3.22.0 for 3.21.3, 1.25-alpine for 1.24-alpine), newest first. Tags
+	// without a version, such as latest, can't be compared.
+	NewerTags []string `json:"newer_tags,omitempty"`
+	// CurrentDigest is the digest the image reference is pinned to, or else
+	// the one the tag resolved to when the environment was built, and
+	// LatestDigest the one the tag resolves to now.
+	CurrentDigest string `json:"current_digest,omitempty"`
+	LatestDigest  string `json:"latest_digest,omitempty"`
+	// DigestChanged is set when the tag moved to another image since.
+	DigestChanged bool `json:"digest_changed,omitempty"`
+}
+
+func (u *ImageUpdate) Available() bool {
+	return len(u.NewerTags) > 0 || u.DigestChanged
+}
+
+// CheckBaseImageUpdate resolves the tag of the base image through the engine
+// to report whether it moved to another image, and probes the next versions
+// of the tag, since the engine can't list the tags of a repository.
+// Resolutions are cached for an hour.
+func (env *Environment) CheckBaseImageUpdate(ctx context.Context) (*ImageUpdate, error) {
+	if env.Config.Dockerfile != "" {
+		return nil, errors.New("update checks are only supported for base images, not Dockerfiles")
+	}
+
+	repository, tag, digest := parseImageReference(env.Config.BaseImage)
+	update := &ImageUpdate{
+		Image:         env.Config.BaseImage,
+		Tag:           tag,
+		CurrentDigest: cmp.Or(digest, env.BaseImageDigest),
+	}
+	if tag == "" {
+		// Only pinned by digest: there's nothing to compare with
+		return update, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, registryTimeout)
+	defer cancel()
+
+	latest, err := env.resolveImageDigest(ctx, repository+":"+tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s:%s: %w", repository, tag, err)
+	}
+	update.LatestDigest = latest
+	update.DigestChanged = update.CurrentDigest != "" && update.CurrentDigest != latest
+
+	update.NewerTags = newerImageTags(tag, func(candidate string) bool {
+		_, err := env.resolveImageDigest(ctx, repository+":"+candidate)
+		return err == nil
+	})
+	return update, nil
+}
+
+// parseImageReference splits an image reference in its repository, tag and
+// digest. The tag defaults to latest unless the reference has a digest.
+func parseImageReference(image string) (repository, tag, digest string) {
+	repository, digest, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, tag = repository[:i], repository[i+1:]
+	} else if digest == "" {
+		tag = "latest"
+	}
+	return repository, tag, digest
+}
+
+// resolveImageDigest returns the digest the image reference resolves to,
+// through the registry mirrors.
+func (env *Environment) resolveImageDigest(ctx context.Context, image string) (string, error) {
+	return cachedRegistryQuery(image, func() (string, error) {
+		ref, err := env.client().Container().From(env.mirrorImage(image)).ImageRef(ctx)
+		if err != nil {
+			return "", err
+		}
+		_, _, digest := parseImageReference(ref)
+		if digest == "" {
+			return "", fmt.Errorf("no digest in the resolved reference %s", ref)
+		}
+		return digest, nil
+	})
+}
+
+// imageVersionRegexp splits a tag in its prefix, version and variant, e.g.
+// v1.24.3-alpine3.21 in v, 1.24.3 and -alpine3.21.
+var imageVersionRegexp = regexp.MustCompile(`^(v?)(\d+(?:\.\d+)*)(.*)$`)
+
+func parseImageVersion(tag string) (string, []int, string, bool) {
+	match := imageVersionRegexp.FindStringSubmatch(tag)
+	if match == nil {
+		return "", nil, "", false
+	}
+	version := []int{}
+	for _, part := range strings.Split(match[2], ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return "", nil, "", false
+		}
+		version = append(version, n)
+	}
+	return match[1], version, match[3], true
+}
+
+// newerImageTags returns the tags with the same format as the current one and
+// a higher version that exist, newest first. From the last component to the
+// first, it bumps the version (1.24.3 to 1.24.4, then 1.25.0, then 2.0.0) for
+// as long as the tag exists.
+func newerImageTags(current string, exists func(tag string) bool) []string {
+	prefix, currentVersion, variant, ok := parseImageVersion(current)
+	if !ok {
+		return nil
+	}
+	format := func(version []int) string {
+		parts := []string{}
+		for _, n := range version {
+			parts = append(parts, strconv.Itoa(n))
+		}
+		return prefix + strings.Join(parts, ".") + variant
+	}
+
+	newer := [][]int{}
+	for i := len(currentVersion) - 1; i >= 0 && len(newer) < maxNewerImageTags; i-- {
+		version := currentVersion
+		for len(newer) < maxNewerImageTags {
+			version = slices.Concat(version[:i], []int{version[i] + 1}, make([]int, len(version)-i-1))
+			if !exists(format(version)) {
+				break
+			}
+			newer = append(newer, version)
+		}
+	}
+	slices.SortFunc(newer, func(a, b []int) int {
+		return slices.Compare(b, a)
+	})
+
+	result := []string{}
+	for _, version := range newer {
+		result = append(result, format(version))
+	}
+	return result
+}
+
+type registryCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	registryCacheMu sync.Mutex
+	registryCache   = map[string]*registryCacheEntry{}
+)
+
+func cachedRegistryQuery(key string, query func() (string, error)) (string, error) {
+	registryCacheMu.Lock()
+	entry, ok := registryCache[key]
+	registryCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := query()
+	if err != nil {
+		return "", err
+	}
+
+	registryCacheMu.Lock()
+	defer registryCacheMu.Unlock()
+	registryCache[key] = &registryCacheEntry{value: value, expires: time.Now().Add(registryCacheTTL)}
+	return value, nil
+}
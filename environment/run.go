@@ -0,0 +1,871 @@
+package environment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// maxOutputSize caps the logs and sessions recorded in the notes.
+const maxOutputSize = 32 * 1024
+
+type RunOpts struct {
+	UseEntrypoint bool
+
+	// Secrets are made available to this command only, as environment
+	// variables. They are never persisted in the configuration, the container
+	// state or the notes, and their values are redacted from the output.
+	Secrets map[string]string
+
+	// CombinedOutput merges stderr into stdout, preserving the order in which
+	// lines were printed as in a terminal. Stderr is then always empty.
+	CombinedOutput bool
+
+	// Stdout and Stderr receive a copy of the command output while it runs,
+	// e.g. for a terminal UI, line by line and redacted. If the image lacks
+	// mkfifo or tee, the output is written once the command completes.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// CaptureStderr returns the stderr of successful commands too, recorded
+	// in the notes. It's implied by Stderr.
+	CaptureStderr bool
+
+	// CacheTTL returns the result of the same successful command against the
+	// same container state, run less than CacheTTL ago, without running it
+	// again. Only opt in for commands that don't change the container, since
+	// a cached run creates no revision. Commands with secrets, or with a
+	// Label or CommitWorkdir, which need a revision, aren't cached.
+	CacheTTL time.Duration
+
+	// AllowedHosts restricts the HTTP(S) destinations of the command to these
+	// hosts ("example.com", or "*.example.com" to include subdomains), through
+	// a filtering proxy. Refused hosts are reported in RunResult.DeniedHosts.
+	// The filtering is advisory: only the clients honoring http_proxy and
+	// https_proxy are restricted, see withEgressProxy.
+	AllowedHosts []string
+
+	// ArtifactPaths are files or directories (relative to the workdir) to
+	// retrieve after the command, even if it failed, e.g. test reports.
+	// Files are returned in the result, or exported under ArtifactsDir on the
+	// host along with directories, keeping their path in the container.
+	ArtifactPaths []string
+	ArtifactsDir  string
+
+	// StdinFromVersion feeds the output recorded by that revision to the
+	// command's standard input (0 for none).
+	StdinFromVersion int
+
+	// Stdin is fed to the command's standard input, e.g. a patch. Only its
+	// size is recorded in the notes past maxStdinNoteSize.
+	Stdin string
+
+	// Label is recorded on the revision to find it later with
+	// History.FindByLabel, e.g. "tests".
+	Label string
+
+	// CommitWorkdir commits the changes of the command to a git repository of
+	// the workdir inside the container, initialized if needed, with the
+	// command as message. Nothing is committed when nothing changed. The
+	// repository is kept outside the workdir (see workdirGitDir), since the
+	// workdir is exported to the worktree of the environment.
+	CommitWorkdir bool
+
+	// ExpectJSON parses the stdout of a successful command into
+	// RunResult.JSON, and fails if it isn't valid JSON. The state changes of
+	// the command are kept either way: the error is returned along with the
+	// result, whose Stdout has the raw output.
+	ExpectJSON bool
+
+	// Workdir runs the command in another directory, absolute or relative to
+	// the current one, leaving the working directory of the environment
+	// unchanged.
+	Workdir string
+
+	// Reproducible sets the variables of EnvironmentConfig.Reproducible
+	// (SOURCE_DATE_EPOCH, TZ, LANG, LC_ALL and PYTHONHASHSEED) for this
+	// command only.
+	Reproducible bool
+
+	// Timeout fails the command if it runs longer, e.g. a server started in
+	// the foreground by mistake (0 for no timeout). No revision is recorded.
+	Timeout time.Duration
+
+	// InteractiveStdin leaves stdin open. By default it's closed, so that a
+	// command prompting for input (e.g. apt without -y) fails right away
+	// instead of hanging.
+	InteractiveStdin bool
+
+	// DetectOutsideChanges diffs the filesystem after a successful command
+	// to report the paths it changed outside the workdir, e.g. in /etc or
+	// /usr, in RunResult.OutsideWorkdir. It's opt-in since diffing the whole
+	// filesystem is costly. Deleted paths aren't reported.
+	DetectOutsideChanges bool
+
+	// Assert is run after the command succeeded, in the same directory and
+	// with the same options, to verify it, e.g. tests after a build. Its exit
+	// code determines the result, reported in RunResult.Assert. Its changes
+	// aren't recorded: the revision is the state left by the command.
+	Assert string
+}
+
+type RunResult struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr,omitempty"`
+	// DeniedHosts are the hosts the command tried to reach outside of
+	// RunOpts.AllowedHosts.
+	DeniedHosts []string    `json:"denied_hosts,omitempty"`
+	Artifacts   []*Artifact `json:"artifacts,omitempty"`
+	// Warnings report the artifacts that couldn't be retrieved.
+	Warnings []string `json:"warnings,omitempty"`
+	// Hint suggests why the command failed, e.g. a prompt for input.
+	Hint string `json:"hint,omitempty"`
+	// JSON is the parsed stdout, with RunOpts.ExpectJSON. Stdout keeps the
+	// raw output.
+	JSON any `json:"json,omitempty"`
+	// OutsideWorkdir are the paths changed outside the workdir, with
+	// RunOpts.DetectOutsideChanges.
+	OutsideWorkdir []string `json:"outside_workdir,omitempty"`
+	// Assert is the result of RunOpts.Assert, if the command succeeded.
+	Assert *RunResult `json:"assert,omitempty"`
+}
+
+// Failed reports whether the command or its assertion failed.
+func (r *RunResult) Failed() bool {
+	return r.FailedPhase() != ""
+}
+
+// FailedPhase returns "command" or "assert" for a failure, "" otherwise.
+func (r *RunResult) FailedPhase() string {
+	switch {
+	case r.ExitCode != 0:
+		return "command"
+	case r.Assert != nil && r.Assert.ExitCode != 0:
+		return "assert"
+	}
+	return ""
+}
+
+// String renders the result for humans and agents.
+func (r *RunResult) String() string {
+	extra := ""
+	if len(r.DeniedHosts) > 0 {
+		extra = fmt.Sprintf("\nblocked connections to: %s", strings.Join(r.DeniedHosts, ", "))
+	}
+	for _, warning := range r.Warnings {
+		extra += "\nwarning: " + warning
+	}
+	if len(r.OutsideWorkdir) > 0 {
+		shown := r.OutsideWorkdir[:min(len(r.OutsideWorkdir), maxOutsideChanges)]
+		extra += "\nwarning: changed outside the workdir: " + strings.Join(shown, ", ")
+		if more := len(r.OutsideWorkdir) - len(shown); more > 0 {
+			extra += fmt.Sprintf(" and %d more", more)
+		}
+	}
+	if r.Hint != "" {
+		extra += "\nhint: " + r.Hint
+	}
+	switch r.FailedPhase() {
+	case "":
+		if r.Assert != nil {
+			return fmt.Sprintf("%s\nassert passed: %s", r.Stdout, r.Assert.Stdout) + extra
+		}
+		return r.Stdout + extra
+	case "assert":
+		return fmt.Sprintf("command succeeded but the assert failed with exit code %d.\ncommand stdout: %s\nassert stdout: %s\nassert stderr: %s%s", r.Assert.ExitCode, r.Stdout, r.Assert.Stdout, r.Assert.Stderr, extra)
+	}
+	return fmt.Sprintf("command failed with exit code %d.\nstdout: %s\nstderr: %s%s", r.ExitCode, r.Stdout, r.Stderr, extra)
+}
+
+// Run runs a command in the environment. The state left by a successful
+// command becomes the next revision, so that its changes to the workdir are
+// the ones exported to the worktree, while a failed command leaves the
+// environment as it was: only its output is recorded in the notes.
+func (env *Environment) Run(ctx context.Context, explanation, command, shell string, opts RunOpts) (*RunResult, error) {
+	return env.run(ctx, explanation, command, shell, nil, opts)
+}
+
+// run runs command, or argv as is when set, in which case command is only
+// what gets recorded and checked against the policies.
+func (env *Environment) run(ctx context.Context, explanation, command, shell string, argv []string, opts RunOpts) (*RunResult, error) {
+	if err := env.Config.checkCommandPolicy(command); err != nil {
+		return nil, err
+	}
+	if err := env.intercept(ctx, command); err != nil {
+		return nil, err
+	}
+	tags := ClassifyCommand(command)
+
+	// displayed is the command as recorded in the notes and history
+	displayed := command
+	currentWorkdir, workdir := "", ""
+	if opts.Workdir != "" {
+		var err error
+		if currentWorkdir, err = env.container.Workdir(ctx); err != nil {
+			return nil, err
+		}
+		workdir = opts.Workdir
+		if !path.IsAbs(workdir) {
+			workdir = path.Join(currentWorkdir, workdir)
+		}
+		if _, err := env.container.Directory(workdir).Sync(ctx); err != nil {
+			return nil, fmt.Errorf("directory %s does not exist in the environment: %w", workdir, err)
+		}
+		displayed = fmt.Sprintf("%s (in %s)", command, workdir)
+	}
+
+	// buildScript applies the options to the command, or the assert, which
+	// gets no stdin
+	buildScript := func(command string, hasStdin bool) string {
+		script := env.Config.withUmask(command)
+		if opts.CombinedOutput {
+			script = "exec 2>&1\n" + script
+		}
+		if opts.Reproducible {
+			script = "export " + strings.Join(reproducibleEnv, " ") + "\n" + script
+		}
+		if !hasStdin && !opts.InteractiveStdin {
+			script = "exec </dev/null\n" + script
+		}
+		return script
+	}
+	args := []string{}
+	if argv != nil {
+		// The program gets its arguments as positional parameters: the shell
+		// only applies the options, without parsing them
+		args = append([]string{shell, "-c", buildScript(`exec "$@"`, opts.Stdin != "" || opts.StdinFromVersion != 0), shell}, argv...)
+	} else if command != "" {
+		args = []string{shell, "-c", buildScript(command, opts.Stdin != "" || opts.StdinFromVersion != 0)}
+	}
+
+	stdin := opts.Stdin
+	if opts.StdinFromVersion != 0 {
+		if opts.Stdin != "" {
+			return nil, errors.New("stdin and stdin from version are mutually exclusive")
+		}
+		revision := env.History.Get(opts.StdinFromVersion)
+		if revision == nil {
+			return nil, fmt.Errorf("version %d not found", opts.StdinFromVersion)
+		}
+		if revision.Output == "" {
+			return nil, fmt.Errorf("version %d has no output", opts.StdinFromVersion)
+		}
+		stdin = revision.Output
+	}
+
+	var cacheKey string
+	if opts.CacheTTL > 0 && len(opts.Secrets) == 0 && len(opts.AllowedHosts) == 0 && len(opts.ArtifactPaths) == 0 && stdin == "" && opts.Assert == "" && opts.Label == "" && !opts.CommitWorkdir {
+		stateID, err := env.container.ID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Every other option changing the result is part of the key
+		cacheKey = strings.Join([]string{
+			string(stateID), shell, command, workdir,
+			strconv.FormatBool(opts.UseEntrypoint),
+			strconv.FormatBool(opts.CombinedOutput),
+			strconv.FormatBool(opts.Reproducible),
+			strconv.FormatBool(opts.Stderr != nil || opts.CaptureStderr),
+			strconv.FormatBool(opts.InteractiveStdin),
+			strconv.FormatBool(opts.DetectOutsideChanges),
+			opts.Timeout.String(),
+		}, "\x00")
+		if cached := cachedRun(cacheKey); cached != nil {
+			env.Notes.Add("$ %s\n(cached)\n%s\n\n", displayed, cached.Stdout)
+			if err := cached.copyOutput(opts); err != nil {
+				return nil, err
+			}
+			if opts.ExpectJSON {
+				if err := cached.parseJSON(); err != nil {
+					return cached, err
+				}
+			}
+			return cached, nil
+		}
+	}
+
+	// annotations precede the output of the command in the notes
+	annotations := tagsNote(tags) + stdinNote(redact(opts.Stdin, opts.Secrets))
+
+	container := env.container
+	if workdir != "" {
+		container = container.WithWorkdir(workdir)
+	}
+	for k, v := range opts.Secrets {
+		container = container.WithSecretVariable(k, env.commandSecret(k, v))
+	}
+	egressID := ""
+	if len(opts.AllowedHosts) > 0 {
+		egressID = strconv.FormatInt(time.Now().UnixNano(), 36)
+		var err error
+		if container, err = env.withEgressProxy(container, egressID, opts.AllowedHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	// failed reports a non-zero exit code. state is only known when the
+	// command was allowed to fail, to collect its artifacts.
+	failed := func(exitCode int, stdout, stderr string, state *dagger.Container) (*RunResult, error) {
+		// Failing commands often dump their environment, configured secrets
+		// included
+		secrets := env.secretValues(ctx, opts.Secrets)
+		result := &RunResult{
+			Command:  command,
+			ExitCode: exitCode,
+			Stdout:   redact(stdout, secrets),
+			Stderr:   redact(stderr, secrets),
+		}
+		if egressID != "" {
+			var err error
+			if result.DeniedHosts, err = env.deniedHosts(ctx, egressID); err != nil {
+				return nil, err
+			}
+		}
+		if state != nil {
+			result.Artifacts, result.Warnings = env.collectArtifacts(ctx, state, opts)
+		}
+		if waitingForInput(result.Stdout) || waitingForInput(result.Stderr) {
+			result.Hint = "the command appears to be waiting for input, run it non-interactively (e.g. with -y, --yes or DEBIAN_FRONTEND=noninteractive)"
+		}
+		env.Notes.Add("$ %s\n%sexit %d\nstdout: %s\nstderr: %s\n\n", displayed, annotations, result.ExitCode, result.Stdout, result.Stderr)
+		if err := result.copyOutput(opts); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	var stream *outputStream
+	if (opts.Stdout != nil || opts.Stderr != nil) && len(args) > 0 {
+		stream = env.newOutputStream(opts)
+		container, args[2] = stream.wrap(container, args[2])
+	}
+
+	execOpts := dagger.ContainerWithExecOpts{
+		UseEntrypoint: opts.UseEntrypoint,
+		Stdin:         stdin,
+	}
+	if len(opts.ArtifactPaths) > 0 {
+		// Reports of failed tests are the most useful artifacts
+		execOpts.Expect = dagger.ReturnTypeAny
+	}
+	newState := container.WithExec(args, execOpts)
+	execCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	release, err := env.execLimiter().acquire(execCtx)
+	if err != nil {
+		return nil, fmt.Errorf("command not started: %w", err)
+	}
+	if stream != nil {
+		stream.start(ctx, env.secretValues(ctx, opts.Secrets))
+	}
+	stdout, err := newState.Stdout(execCtx)
+	release()
+	if stream != nil {
+		// Only the output that couldn't be streamed is left to copy, the
+		// stderr is still returned
+		opts.CaptureStderr = opts.CaptureStderr || opts.Stderr != nil
+		var streamErr error
+		if opts.Stdout, opts.Stderr, streamErr = stream.wait(); streamErr != nil {
+			return nil, fmt.Errorf("failed to stream the output: %w", streamErr)
+		}
+	}
+	if err != nil {
+		if errors.Is(execCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			env.Notes.Add("$ %s\n%stimed out after %s\n\n", displayed, annotations, opts.Timeout)
+			return nil, fmt.Errorf("command exceeded timeout of %s", opts.Timeout)
+		}
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return failed(exitErr.ExitCode, exitErr.Stdout, exitErr.Stderr, nil)
+		}
+		return nil, err
+	}
+	if len(opts.ArtifactPaths) > 0 {
+		exitCode, err := newState.ExitCode(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if exitCode != 0 {
+			stderr, err := newState.Stderr(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return failed(exitCode, stdout, stderr, newState)
+		}
+	}
+	// Configured secrets are redacted too, a command may well print them
+	secrets := env.secretValues(ctx, opts.Secrets)
+	result := &RunResult{
+		Command: command,
+		Stdout:  redact(stdout, secrets),
+	}
+	if len(opts.ArtifactPaths) > 0 {
+		result.Artifacts, result.Warnings = env.collectArtifacts(ctx, newState, opts)
+	}
+	if opts.Stderr != nil || opts.CaptureStderr {
+		stderr, err := newState.Stderr(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result.Stderr = redact(stderr, secrets)
+	}
+	if stream != nil {
+		newState = newState.WithoutMount(runOutputDir)
+	}
+
+	if opts.Assert != "" {
+		if result.Assert, err = env.runAssert(execCtx, newState, shell, buildScript(opts.Assert, false), opts); err != nil {
+			return nil, fmt.Errorf("failed to run the assert: %w", err)
+		}
+		result.Assert.Command = opts.Assert
+	}
+
+	if egressID != "" {
+		if result.DeniedHosts, err = env.deniedHosts(ctx, egressID); err != nil {
+			return nil, err
+		}
+		// Only keep the files: the proxy settings and binding are for this
+		// command only
+		newState = env.container.WithRootfs(newState.Rootfs())
+	}
+
+	// Per-run secrets must not leak into the recorded state. One shadowing a
+	// configured secret gives it back.
+	for k := range opts.Secrets {
+		newState = newState.WithoutSecretVariable(k)
+		if i := slices.IndexFunc(env.Config.Secrets, secretNamed(k)); i >= 0 {
+			_, v, _ := strings.Cut(env.Config.Secrets[i], "=")
+			newState = newState.WithSecretVariable(k, env.client().Secret(v))
+		}
+	}
+
+	if workdir != "" {
+		newState = newState.WithWorkdir(currentWorkdir)
+	}
+
+	if opts.DetectOutsideChanges {
+		if result.OutsideWorkdir, err = env.changesOutsideWorkdir(ctx, newState); err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("failed to detect changes outside the workdir: %s", err))
+		}
+	}
+
+	if opts.CommitWorkdir {
+		committed, err := commitWorkdir(ctx, newState, env.Config.Workdir, command)
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("failed to commit the workdir: %s", err))
+		} else if committed != nil {
+			newState = committed
+		}
+	}
+
+	previousVersion := env.History.LatestVersion()
+	if err := env.apply(ctx, "Run "+displayed, explanation, result.Stdout, newState, tags...); err != nil {
+		return nil, err
+	}
+	// No revision is added for a no-op with SkipNoopRevisions
+	if latest := env.History.Latest(); opts.Label != "" && latest.Version > previousVersion {
+		latest.Label = opts.Label
+	}
+
+	if result.Stderr != "" {
+		env.Notes.Add("$ %s\n%sstdout: %s\nstderr: %s\n\n", displayed, annotations, result.Stdout, result.Stderr)
+	} else {
+		env.Notes.Add("$ %s\n%s%s\n\n", displayed, annotations, result.Stdout)
+	}
+	if result.Assert != nil {
+		env.Notes.Add("assert $ %s\nexit %d\nstdout: %s\nstderr: %s\n\n", opts.Assert, result.Assert.ExitCode, result.Assert.Stdout, result.Assert.Stderr)
+	}
+	if cacheKey != "" {
+		cacheRun(cacheKey, result, opts.CacheTTL)
+	}
+	if err := result.copyOutput(opts); err != nil {
+		return nil, err
+	}
+	if opts.ExpectJSON {
+		// The revision is already applied: the raw output stays available
+		if err := result.parseJSON(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// runAssert runs the script of RunOpts.Assert on the state left by the
+// command, once it succeeded. A failing assert isn't an error: its exit code
+// is in the result.
+func (env *Environment) runAssert(ctx context.Context, state *dagger.Container, shell, script string, opts RunOpts) (*RunResult, error) {
+	release, err := env.execLimiter().acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	assert := state.WithExec([]string{shell, "-c", script}, dagger.ContainerWithExecOpts{
+		Expect: dagger.ReturnTypeAny,
+	})
+	exitCode, err := assert.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := assert.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := assert.Stderr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secrets := env.secretValues(ctx, opts.Secrets)
+	return &RunResult{
+		ExitCode: exitCode,
+		Stdout:   redact(stdout, secrets),
+		Stderr:   redact(stderr, secrets),
+	}, nil
+}
+
+// maxOutsideChanges caps the paths changed outside the workdir listed in the
+// human readable result.
+const maxOutsideChanges = 20
+
+// changesOutsideWorkdir returns the files and empty directories added or
+// modified in the state, compared to the current one, outside the workdir.
+func (env *Environment) changesOutsideWorkdir(ctx context.Context, state *dagger.Container) ([]string, error) {
+	workdir, err := env.container.Workdir(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := env.container.Rootfs().Diff(state.Rootfs()).Glob(ctx, "**")
+	if err != nil {
+		return nil, err
+	}
+	// Only keep the deepest paths: /etc/apt/sources.list, not /etc
+	parents := map[string]bool{}
+	for i, p := range paths {
+		paths[i] = "/" + strings.TrimSuffix(p, "/")
+		for dir := path.Dir(paths[i]); dir != "/"; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	slices.Sort(paths)
+
+	changed := []string{}
+	for _, p := range paths {
+		if p == workdir || strings.HasPrefix(p, workdir+"/") || parents[p] {
+			continue
+		}
+		changed = append(changed, p)
+	}
+	return changed, nil
+}
+
+// jsonSnippetSize is how much output is quoted around a JSON syntax error.
+const jsonSnippetSize = 40
+
+func (r *RunResult) parseJSON() error {
+	err := json.Unmarshal([]byte(r.Stdout), &r.JSON)
+	if err == nil {
+		return nil
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		start := max(int(syntaxErr.Offset)-jsonSnippetSize/2, 0)
+		end := min(start+jsonSnippetSize, len(r.Stdout))
+		return fmt.Errorf("output is not valid JSON: %w at offset %d near %q", err, syntaxErr.Offset, r.Stdout[start:end])
+	}
+	return fmt.Errorf("output is not valid JSON: %w (output starts with %q)", err, r.Stdout[:min(jsonSnippetSize, len(r.Stdout))])
+}
+
+// RunWithStreams runs a command like Run and returns both its stdout and its
+// stderr, whether it succeeds or not. A non-zero exit code is an error.
+func (env *Environment) RunWithStreams(ctx context.Context, explanation, command, shell string, useEntrypoint bool) (string, string, error) {
+	result, err := env.Run(ctx, explanation, command, shell, RunOpts{
+		UseEntrypoint: useEntrypoint,
+		CaptureStderr: true,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if result.Failed() {
+		return result.Stdout, result.Stderr, fmt.Errorf("command failed with exit code %d", result.ExitCode)
+	}
+	return result.Stdout, result.Stderr, nil
+}
+
+// templatePlaceholderRegexp matches the {{name}} placeholders of
+// RenderCommandTemplate.
+var templatePlaceholderRegexp = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// RenderCommandTemplate replaces the {{name}} placeholders of the template
+// with the value of the argument of that name, quoted as a single shell word:
+// unless it only contains letters, digits and _@%+=:,./- it's wrapped in
+// single quotes, and each single quote it contains is escaped by closing the
+// quotes, adding \' and opening them again. The shell never interprets the
+// value, whatever it contains (spaces, $, backticks, globs, newlines...), so
+// placeholders must not be quoted in the template. Every placeholder needs an
+// argument and every argument must be used, to catch typos.
+func RenderCommandTemplate(template string, args map[string]string) (string, error) {
+	used := map[string]bool{}
+	var missing []string
+	command := templatePlaceholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := templatePlaceholderRegexp.FindStringSubmatch(placeholder)[1]
+		value, ok := args[name]
+		if !ok {
+			missing = append(missing, name)
+			return placeholder
+		}
+		used[name] = true
+		return shellWord(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for the placeholders: %s", strings.Join(missing, ", "))
+	}
+	for _, name := range slices.Sorted(maps.Keys(args)) {
+		if !used[name] {
+			return "", fmt.Errorf("argument %s is not used by the template", name)
+		}
+	}
+	return command, nil
+}
+
+// RunTemplate runs the command rendered by RenderCommandTemplate, to pass
+// values such as file names to a command without risking shell injection.
+func (env *Environment) RunTemplate(ctx context.Context, explanation, template string, args map[string]string, shell string, opts RunOpts) (*RunResult, error) {
+	command, err := RenderCommandTemplate(template, args)
+	if err != nil {
+		return nil, err
+	}
+	return env.Run(ctx, explanation, command, shell, opts)
+}
+
+// RunArgs runs a program with its arguments as is: argv is executed directly,
+// never parsed by a shell. The shell only sets up the options of Run (umask,
+// stdin, ...) before replacing itself with the program, and runs the Assert.
+// The command recorded, and matched against the command policies, quotes each
+// element of argv like the values of RenderCommandTemplate, leaving the safe
+// ones unquoted so that it stays readable.
+func (env *Environment) RunArgs(ctx context.Context, explanation string, argv []string, shell string, opts RunOpts) (*RunResult, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("no program to run")
+	}
+	quoted := make([]string, 0, len(argv))
+	for _, arg := range argv {
+		quoted = append(quoted, shellWord(arg))
+	}
+	return env.run(ctx, explanation, strings.Join(quoted, " "), shell, argv, opts)
+}
+
+type cachedRunResult struct {
+	result  RunResult
+	expires time.Time
+}
+
+// runCache holds the results of Run with a CacheTTL, keyed by container state
+// and command, for the lifetime of the process.
+var (
+	runCacheMu sync.Mutex
+	runCache   = map[string]*cachedRunResult{}
+)
+
+func cachedRun(key string) *RunResult {
+	runCacheMu.Lock()
+	defer runCacheMu.Unlock()
+
+	cached, ok := runCache[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil
+	}
+	result := cached.result
+	return &result
+}
+
+func cacheRun(key string, result *RunResult, ttl time.Duration) {
+	runCacheMu.Lock()
+	defer runCacheMu.Unlock()
+
+	now := time.Now()
+	maps.DeleteFunc(runCache, func(_ string, cached *cachedRunResult) bool {
+		return now.After(cached.expires)
+	})
+	runCache[key] = &cachedRunResult{result: *result, expires: now.Add(ttl)}
+}
+
+func (r *RunResult) copyOutput(opts RunOpts) error {
+	if opts.Stdout != nil {
+		if _, err := io.WriteString(opts.Stdout, r.Stdout); err != nil {
+			return fmt.Errorf("failed to write stdout: %w", err)
+		}
+	}
+	if opts.Stderr != nil {
+		if _, err := io.WriteString(opts.Stderr, r.Stderr); err != nil {
+			return fmt.Errorf("failed to write stderr: %w", err)
+		}
+	}
+	return nil
+}
+
+func redact(output string, secrets map[string]string) string {
+	for _, v := range secrets {
+		if v == "" {
+			continue
+		}
+		output = strings.ReplaceAll(output, v, "***")
+	}
+	return output
+}
+
+// workdirGitDir is the repository CommitWorkdir commits to. The workdir has
+// the .git file of the host worktree, pointing to a repository that doesn't
+// exist in the container, and anything written there would be exported over
+// the worktree.
+const workdirGitDir = "/.cu/workdir-git"
+
+// workdirCommitScript prints "committed" only when there was something to
+// commit, so that the container state is otherwise left untouched.
+const workdirCommitScript = `[ -d "$GIT_DIR" ] || git init -q || exit 1
+git add -A || exit 1
+git diff --cached --quiet && exit 0
+git -c user.name=container-use -c user.email=container-use@dagger.io commit -q -m "$CU_COMMIT_MESSAGE" && echo committed`
+
+// commitWorkdir returns the state with the changes of the workdir committed,
+// or nil if there were none.
+func commitWorkdir(ctx context.Context, state *dagger.Container, workdir, message string) (*dagger.Container, error) {
+	committed := state.
+		WithEnvVariable("CU_COMMIT_MESSAGE", message).
+		WithEnvVariable("GIT_DIR", workdirGitDir).
+		WithEnvVariable("GIT_WORK_TREE", workdir).
+		WithExec([]string{"sh", "-c", workdirCommitScript}).
+		WithoutEnvVariable("CU_COMMIT_MESSAGE").
+		WithoutEnvVariable("GIT_DIR").
+		WithoutEnvVariable("GIT_WORK_TREE")
+	stdout, err := committed.Stdout(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%s", strings.TrimSpace(exitErr.Stderr))
+		}
+		return nil, err
+	}
+	if strings.TrimSpace(stdout) != "committed" {
+		return nil, nil
+	}
+	return committed, nil
+}
+
+// maxStdinNoteSize is the largest stdin recorded verbatim in the notes.
+const maxStdinNoteSize = 4 * 1024
+
+func stdinNote(stdin string) string {
+	switch {
+	case stdin == "":
+		return ""
+	case len(stdin) > maxStdinNoteSize:
+		return fmt.Sprintf("stdin: %d bytes\n", len(stdin))
+	default:
+		return fmt.Sprintf("stdin:\n%s\n", strings.TrimRight(stdin, "\n"))
+	}
+}
+
+// promptRegexp matches the usual prompts for input.
+var promptRegexp = regexp.MustCompile(`(?i)(\[y/n\]|\(y/n\)|\[yes/no\]|\(yes/no\)|press (any key|enter)|password|passphrase|continue\?|proceed\?)`)
+
+// waitingForInput checks whether the output ends with a prompt.
+func waitingForInput(output string) bool {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return promptRegexp.MatchString(lines[len(lines)-1])
+}
+
+// withUmask prefixes the command with the configured umask.
+func (config *EnvironmentConfig) withUmask(command string) string {
+	if config.Umask == "" {
+		return command
+	}
+	return fmt.Sprintf("umask %s\n%s", config.Umask, command)
+}
+
+// truncate keeps the end of long outputs, where errors usually are.
+func truncate(output string) string {
+	if len(output) <= maxOutputSize {
+		return output
+	}
+	return fmt.Sprintf("[%d bytes truncated]\n%s", len(output)-maxOutputSize, output[len(output)-maxOutputSize:])
+}
+
+// projectMarkers identify the root of a package in a monorepo.
+var projectMarkers = []string{"package.json", "go.mod", "pyproject.toml"}
+
+// RunNear runs the command in the nearest directory containing fileOrDir that
+// has a project marker (package.json, go.mod, pyproject.toml), without going
+// above the workdir.
+func (env *Environment) RunNear(ctx context.Context, explanation, fileOrDir, command, shell string, opts RunOpts) (*RunResult, error) {
+	dir, err := env.findProjectDir(ctx, fileOrDir)
+	if err != nil {
+		return nil, err
+	}
+	opts.Workdir = dir
+	return env.Run(ctx, explanation, command, shell, opts)
+}
+
+func (env *Environment) findProjectDir(ctx context.Context, fileOrDir string) (string, error) {
+	dir := fileOrDir
+	if !path.IsAbs(dir) {
+		dir = path.Join(env.Config.Workdir, dir)
+	}
+	dir = path.Clean(dir)
+	if dir != env.Config.Workdir && !strings.HasPrefix(dir, env.Config.Workdir+"/") {
+		return "", fmt.Errorf("%s is outside of the workdir %s", fileOrDir, env.Config.Workdir)
+	}
+
+	// Files are looked up from their directory
+	if _, err := env.container.Directory(dir).Sync(ctx); err != nil {
+		dir = path.Dir(dir)
+	}
+
+	for {
+		entries, err := env.container.Directory(dir).Entries(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, marker := range projectMarkers {
+			if slices.Contains(entries, marker) {
+				return dir, nil
+			}
+		}
+		if dir == env.Config.Workdir || dir == "/" {
+			return "", fmt.Errorf("no project marker (%s) found above %s", strings.Join(projectMarkers, ", "), fileOrDir)
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// safeShellWordRegexp matches the words the shell takes literally.
+var safeShellWordRegexp = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellWord quotes s only if needed.
+func shellWord(s string) string {
+	if safeShellWordRegexp.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
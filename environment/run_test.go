@@ -0,0 +1,163 @@
+package environment
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dagger.io/dagger"
+)
+
+// testClient connects to the dagger engine, or skips the test without one:
+// run the tests with `dagger run go test ./...` to include them.
+func testClient(t *testing.T) *dagger.Client {
+	t.Helper()
+	if os.Getenv("DAGGER_SESSION_PORT") == "" {
+		t.Skip("no dagger engine, run the tests with `dagger run go test ./...`")
+	}
+	client, err := dagger.Connect(context.Background(), dagger.WithLogOutput(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testWorktree returns a worktree with the given environment configuration.
+func testWorktree(t *testing.T, config string) string {
+	t.Helper()
+	worktree := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(worktree, configDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, configDir, environmentFile), []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return worktree
+}
+
+const (
+	testSecret       = "s3cr3t-per-command"
+	testConfigSecret = "s3cr3t-configured"
+)
+
+func TestRunRedactsSecretsOfFailedCommand(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CU_TEST_API_KEY", testConfigSecret)
+	worktree := testWorktree(t, `{"base_image": "alpine:3.21", "secrets": ["API_KEY=env://CU_TEST_API_KEY"]}`)
+	env, err := New(ctx, "test/redact", "test", worktree, testClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Notes.Pop()
+
+	result, err := env.Run(ctx, "Leak the secrets", `echo "token=$TOKEN"; echo "key=$API_KEY" >&2; exit 3`, "sh", RunOpts{
+		Secrets: map[string]string{"TOKEN": testSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %d", result.ExitCode)
+	}
+	if result.Stdout != "token=***\n" || result.Stderr != "key=***\n" {
+		t.Errorf("expected the secrets to be redacted, got stdout %q and stderr %q", result.Stdout, result.Stderr)
+	}
+	if notes := env.Notes.Pop(); strings.Contains(notes, testSecret) || strings.Contains(notes, testConfigSecret) {
+		t.Errorf("expected the secrets to be redacted from the notes, got %q", notes)
+	}
+}
+
+func TestRunRedactsSecretsOfSuccessfulCommand(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CU_TEST_API_KEY", testConfigSecret)
+	worktree := testWorktree(t, `{"base_image": "alpine:3.21", "secrets": ["API_KEY=env://CU_TEST_API_KEY"]}`)
+	env, err := New(ctx, "test/redact", "test", worktree, testClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Notes.Pop()
+
+	result, err := env.Run(ctx, "Print the secrets", `echo "token=$TOKEN"; echo "key=$API_KEY" >&2`, "sh", RunOpts{
+		Secrets:       map[string]string{"TOKEN": testSecret},
+		CaptureStderr: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "token=***\n" || result.Stderr != "key=***\n" {
+		t.Errorf("expected the secrets to be redacted, got stdout %q and stderr %q", result.Stdout, result.Stderr)
+	}
+	if notes := env.Notes.Pop(); strings.Contains(notes, testSecret) || strings.Contains(notes, testConfigSecret) {
+		t.Errorf("expected the secrets to be redacted from the notes, got %q", notes)
+	}
+}
+
+func TestSetupFailureRedactsSecrets(t *testing.T) {
+	t.Setenv("CU_TEST_API_KEY", testConfigSecret)
+	worktree := testWorktree(t, `{
+		"base_image": "alpine:3.21",
+		"secrets": ["API_KEY=env://CU_TEST_API_KEY"],
+		"setup_commands": ["echo \"key=$API_KEY\"; exit 1"]
+	}`)
+
+	_, err := New(context.Background(), "test/redact", "test", worktree, testClient(t))
+	if err == nil {
+		t.Fatal("expected the setup command to fail")
+	}
+	if strings.Contains(err.Error(), testConfigSecret) {
+		t.Errorf("expected the secret to be redacted from the error, got %q", err)
+	}
+	if !strings.Contains(err.Error(), "key=***") {
+		t.Errorf("expected the redacted output in the error, got %q", err)
+	}
+}
+
+func TestRunSecretShadowingConfiguredSecret(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CU_TEST_API_KEY", testConfigSecret)
+	worktree := testWorktree(t, `{"base_image": "alpine:3.21", "secrets": ["API_KEY=env://CU_TEST_API_KEY"]}`)
+	env, err := New(ctx, "test/shadow", "test", worktree, testClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := `[ "$API_KEY" = "` + testConfigSecret + `" ] && echo configured || echo other`
+	result, err := env.Run(ctx, "Shadow the configured secret", check, "sh", RunOpts{
+		Secrets: map[string]string{"API_KEY": testSecret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "other\n" {
+		t.Fatalf("expected the per-run secret to shadow the configured one, got %q", result.Stdout)
+	}
+
+	result, err = env.Run(ctx, "Check the configured secret", check, "sh", RunOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "configured\n" {
+		t.Errorf("expected the configured secret to be kept after the run, got %q", result.Stdout)
+	}
+}
+
+func TestRunArgsPassesArgumentsAsIs(t *testing.T) {
+	ctx := context.Background()
+	env, err := New(ctx, "test/args", "test", testWorktree(t, `{"base_image": "alpine:3.21"}`), testClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argv := []string{"printf", `%s|`, "with space", `it's "quoted"`, "$(id -u)", "*", ""}
+	result, err := env.RunArgs(ctx, "Print the arguments", argv, "sh", RunOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `with space|it's "quoted"|$(id -u)|*||`; result.Stdout != want {
+		t.Errorf("expected %q, got %q", want, result.Stdout)
+	}
+}
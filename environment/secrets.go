@@ -0,0 +1,112 @@
+package environment
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// AddSecret adds a secret reference (e.g. API_KEY=env://API_KEY), replacing
+// any secret with the same name. The secret is set on the current container
+// rather than rebuilding the environment.
+func (env *Environment) AddSecret(ctx context.Context, explanation, spec string) error {
+	if err := env.checkUnlocked(); err != nil {
+		return err
+	}
+	if err := validateVariables("secret", []string{spec}); err != nil {
+		return err
+	}
+	k, v, _ := strings.Cut(spec, "=")
+	if !strings.Contains(v, "://") {
+		return fmt.Errorf("invalid secret: %s (expected NAME=schema://value)", k)
+	}
+
+	env.Config.Secrets = slices.DeleteFunc(env.Config.Secrets, secretNamed(k))
+	env.Config.Secrets = append(env.Config.Secrets, spec)
+
+	newState := env.container.WithSecretVariable(k, env.client().Secret(v))
+	if err := env.apply(ctx, "Add secret "+k, explanation, "", newState); err != nil {
+		return err
+	}
+
+	env.Notes.Add("Add secret %s\n%s\n\n", k, explanation)
+
+	return nil
+}
+
+// RemoveSecret removes a secret from the configuration and the container.
+func (env *Environment) RemoveSecret(ctx context.Context, explanation, name string) error {
+	if err := env.checkUnlocked(); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(env.Config.Secrets, secretNamed(name)) {
+		return fmt.Errorf("secret %s not found", name)
+	}
+
+	env.Config.Secrets = slices.DeleteFunc(env.Config.Secrets, secretNamed(name))
+
+	newState := env.container.WithoutSecretVariable(name)
+	if err := env.apply(ctx, "Remove secret "+name, explanation, "", newState); err != nil {
+		return err
+	}
+
+	env.Notes.Add("Remove secret %s\n%s\n\n", name, explanation)
+
+	return nil
+}
+
+func secretNamed(name string) func(string) bool {
+	return func(secret string) bool {
+		k, _, _ := strings.Cut(secret, "=")
+		return k == name
+	}
+}
+
+// commandSecret is a secret given to a single command.
+func (env *Environment) commandSecret(name, value string) *dagger.Secret {
+	return env.client().SetSecret(env.commandSecretName(name, value), value)
+}
+
+// commandSecretName includes a hash of the value, since the engine may keep
+// serving the previous value of a secret set again under the same name.
+func (env *Environment) commandSecretName(name, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return fmt.Sprintf("%s-%s-%s", env.ID, name, hex.EncodeToString(sum[:8]))
+}
+
+// secretValues resolves the configured secrets along with extra ones, to
+// redact them from the output of failed commands. Secrets that can't be
+// resolved are skipped.
+func (env *Environment) secretValues(ctx context.Context, extra map[string]string) map[string]string {
+	values := map[string]string{}
+	maps.Copy(values, extra)
+	for _, secret := range env.Config.Secrets {
+		k, v, found := strings.Cut(secret, "=")
+		if !found {
+			continue
+		}
+		plaintext, err := env.client().Secret(v).Plaintext(ctx)
+		if err != nil {
+			slog.Warn("Failed to resolve secret for redaction", "environment", env.ID, "secret", k, "err", err)
+			continue
+		}
+		// Don't collide with a per-command secret of the same name
+		values["config:"+k] = plaintext
+	}
+	return values
+}
+
+func (env *Environment) checkUnlocked() error {
+	if env.Config.Locked(env.Worktree) {
+		return fmt.Errorf("Environment is locked, no updates allowed. Try to make do with the current environment or ask a human to remove the lock file (%s)", path.Join(env.Worktree, configDir, lockFile))
+	}
+	return nil
+}
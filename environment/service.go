@@ -4,24 +4,93 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"dagger.io/dagger"
 )
 
 type Service struct {
-	Config    *ServiceConfig   `json:"config"`
-	Endpoints EndpointMappings `json:"endpoints"`
+	ID        string            `json:"id,omitempty"`
+	Config    *ServiceConfig    `json:"config"`
+	Endpoints EndpointMappings  `json:"endpoints"`
+	Restarts  int               `json:"restarts,omitempty"`
+	ReadyLog  string            `json:"ready_log,omitempty"`
+	Limits    *ServiceLimits    `json:"limits,omitempty"`
+	Volumes   map[string]string `json:"volumes,omitempty"`
 
-	svc *dagger.Service
+	svc        *dagger.Service
+	envID      string
+	client     *dagger.Client
+	restarting bool
+	// Services started with RestartOnChange are restarted by reloadTimer
+	restartOnChange bool
+	reloadTimer     *time.Timer
+	drainTimeout    time.Duration
+
+	// Background services are persisted to be reattached after a restart
+	state      string
+	args       []string
+	entrypoint bool
+	// secrets are the names of the per-command secrets the state refers to,
+	// by variable
+	secrets map[string]string
+	// stdin is set when the state mounts the stdin of the command as a secret
+	stdin bool
+}
+
+// EndpointMappings returns the endpoints by port, as RunBackground returned
+// them before it returned the service.
+func (s *Service) EndpointMappings() EndpointMappings {
+	return s.Endpoints
 }
 
 type EndpointMapping struct {
-	Internal string `json:"internal"`
-	External string `json:"external"`
+	Internal string        `json:"internal"`
+	External string        `json:"external"`
+	Health   *HealthStatus `json:"health,omitempty"`
+	Note     string        `json:"note,omitempty"`
+	// HostPortRequested is set when the external port is the host port
+	// requested with RunBackgroundOpts.HostPorts, rather than a random one.
+	HostPortRequested bool `json:"host_port_requested,omitempty"`
+	// ReassignedFrom is the requested host port, when it was in use.
+	ReassignedFrom int `json:"reassigned_from,omitempty"`
+	// Detected is set when the port was found in the command output.
+	Detected bool `json:"detected,omitempty"`
+	// Certificate is the PEM certificate of an https:// external endpoint.
+	Certificate string `json:"certificate,omitempty"`
+	// Protocol is set for UDP ports, empty for TCP.
+	Protocol dagger.NetworkProtocol `json:"protocol,omitempty"`
+
+	tunnel *dagger.Service
+	proxy  *countingProxy
+}
+
+func (e *EndpointMapping) protocol() dagger.NetworkProtocol {
+	if e.Protocol == "" {
+		return dagger.NetworkProtocolTcp
+	}
+	return e.Protocol
 }
 
 type EndpointMappings map[int]*EndpointMapping
 
+// protocols returns the ports that aren't TCP, in the format of
+// RunBackgroundOpts.Protocols.
+func (m EndpointMappings) protocols() map[int]dagger.NetworkProtocol {
+	var protocols map[int]dagger.NetworkProtocol
+	for port, endpoint := range m {
+		if endpoint.Protocol == "" {
+			continue
+		}
+		if protocols == nil {
+			protocols = map[int]dagger.NetworkProtocol{}
+		}
+		protocols[port] = endpoint.Protocol
+	}
+	return protocols
+}
+
 func (env *Environment) startServices(ctx context.Context) ([]*Service, error) {
 	services := []*Service{}
 	for _, cfg := range env.Config.Services {
@@ -35,8 +104,8 @@ func (env *Environment) startServices(ctx context.Context) ([]*Service, error) {
 }
 
 func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*Service, error) {
-	container := dag.Container().From(cfg.Image)
-	container, err := containerWithEnvAndSecrets(container, cfg.Env, cfg.Secrets)
+	container := env.client().Container().From(env.mirrorImage(cfg.Image))
+	container, err := env.containerWithEnvAndSecrets(container, cfg.Env, cfg.Secrets, env.Config.ExpandEnv)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +148,7 @@ func (env *Environment) startService(ctx context.Context, cfg *ServiceConfig) (*
 		endpoints[port] = endpoint
 
 		// Expose ports on the host
-		tunnel, err := dag.Host().Tunnel(svc, dagger.HostTunnelOpts{
+		tunnel, err := env.client().Host().Tunnel(svc, dagger.HostTunnelOpts{
 			Ports: []dagger.PortForward{
 				{
 					Backend:  port,
@@ -126,3 +195,105 @@ func (env *Environment) AddService(ctx context.Context, explanation string, cfg
 
 	return svc, nil
 }
+
+// ServiceSpec describes a background service started by StartServices.
+type ServiceSpec struct {
+	Name    string
+	Command string
+	// Shell runs the command (default: sh)
+	Shell string
+	Ports []int
+	// DependsOn names the services to start first, from the same batch or
+	// already running. They're reachable by their name as hostname.
+	DependsOn []string
+	// Opts.WaitForLog is the readiness check: dependents start once it
+	// matched. Without it, a service is ready when its ports accept
+	// connections.
+	Opts RunBackgroundOpts
+}
+
+// StartServices starts a set of interdependent services in dependency order,
+// each one waiting for its dependencies to be ready. If any fails, the ones
+// already started by the batch are stopped.
+func (env *Environment) StartServices(ctx context.Context, specs []ServiceSpec) (_ []*Service, rerr error) {
+	order, err := serviceStartOrder(specs)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []*Service{}
+	defer func() {
+		if rerr == nil {
+			return
+		}
+		for _, service := range services {
+			if err := service.Stop(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("Failed to stop background service", "environment", env.ID, "name", service.Config.Name, "err", err)
+			}
+		}
+	}()
+
+	for _, spec := range order {
+		opts := spec.Opts
+		opts.Name = spec.Name
+		opts.DependsOn = spec.DependsOn
+		shell := spec.Shell
+		if shell == "" {
+			shell = "sh"
+		}
+		service, err := env.RunBackground(ctx, "Start "+spec.Name, spec.Command, shell, spec.Ports, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start service %s: %w", spec.Name, err)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// serviceStartOrder sorts the specs so that every service comes after its
+// dependencies from the batch.
+func serviceStartOrder(specs []ServiceSpec) ([]ServiceSpec, error) {
+	byName := map[string]ServiceSpec{}
+	for _, spec := range specs {
+		if spec.Name == "" {
+			return nil, errors.New("every service needs a name")
+		}
+		if _, ok := byName[spec.Name]; ok {
+			return nil, fmt.Errorf("service %s is declared twice", spec.Name)
+		}
+		byName[spec.Name] = spec
+	}
+
+	order := []ServiceSpec{}
+	// visiting detects cycles, visited services are already ordered
+	visiting := map[string]bool{}
+	visited := map[string]bool{}
+	var visit func(spec ServiceSpec) error
+	visit = func(spec ServiceSpec) error {
+		if visited[spec.Name] {
+			return nil
+		}
+		if visiting[spec.Name] {
+			return fmt.Errorf("dependency cycle through service %s", spec.Name)
+		}
+		visiting[spec.Name] = true
+		for _, name := range spec.DependsOn {
+			// Dependencies outside of the batch must already be running
+			if dependency, ok := byName[name]; ok {
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+		visiting[spec.Name] = false
+		visited[spec.Name] = true
+		order = append(order, spec)
+		return nil
+	}
+	for _, spec := range specs {
+		if err := visit(spec); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,63 @@
+package environment
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// Stashes are kept in the memory of the process, per environment ID, since
+// environments are reloaded for every operation. They're lost when it exits.
+var (
+	stashMu sync.Mutex
+	stashes = map[string]map[string]*dagger.Container{}
+)
+
+// Stash remembers the current state under a name, replacing any previous
+// stash with the same name, to go back to it with Pop. Unlike checkpoints,
+// stashes don't persist: they're meant for quick experiments within a session.
+func (env *Environment) Stash(name string) {
+	stashMu.Lock()
+	defer stashMu.Unlock()
+
+	if stashes[env.ID] == nil {
+		stashes[env.ID] = map[string]*dagger.Container{}
+	}
+	stashes[env.ID][name] = env.container
+}
+
+// Pop restores the state stashed under the name as a new revision, and
+// forgets the stash.
+func (env *Environment) Pop(ctx context.Context, name string) error {
+	stashMu.Lock()
+	container, ok := stashes[env.ID][name]
+	stashMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no stash named %s", name)
+	}
+
+	explanation := fmt.Sprintf("Restore the state stashed as %s", name)
+	if err := env.apply(ctx, "Pop "+name, explanation, "", container); err != nil {
+		return err
+	}
+
+	stashMu.Lock()
+	delete(stashes[env.ID], name)
+	stashMu.Unlock()
+
+	env.Notes.Add("Pop %s\n%s\n\n", name, explanation)
+
+	return nil
+}
+
+// Stashes returns the names of the stashes of the environment.
+func (env *Environment) Stashes() []string {
+	stashMu.Lock()
+	defer stashMu.Unlock()
+
+	return slices.Sorted(maps.Keys(stashes[env.ID]))
+}
@@ -9,7 +9,35 @@ import (
 )
 
 type State struct {
-	Container string `json:"container"`
+	Container       string               `json:"container"`
+	History         History              `json:"history,omitempty"`
+	Services        []*BackgroundService `json:"services,omitempty"`
+	BaseImageDigest string               `json:"base_image_digest,omitempty"`
+}
+
+// BackgroundService records a service started by RunBackground so that it can
+// be reattached when the server restarts.
+type BackgroundService struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name,omitempty"`
+	Command       string            `json:"command"`
+	Ports         []int             `json:"ports,omitempty"`
+	Env           []string          `json:"env,omitempty"`
+	Container     string            `json:"container"`
+	Args          []string          `json:"args,omitempty"`
+	UseEntrypoint bool              `json:"use_entrypoint,omitempty"`
+	Limits        *ServiceLimits    `json:"limits,omitempty"`
+	Volumes       map[string]string `json:"volumes,omitempty"`
+	// RestartOnChange is kept to restart the service on change once reattached
+	RestartOnChange bool `json:"restart_on_change,omitempty"`
+	// Protocols are the ports that aren't TCP
+	Protocols map[int]dagger.NetworkProtocol `json:"protocols,omitempty"`
+	// Secrets are the names of the per-command secrets the container refers
+	// to, by variable. Their values aren't persisted.
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// Stdin is set when the command was fed a stdin, which isn't persisted
+	// either.
+	Stdin bool `json:"stdin,omitempty"`
 }
 
 func migrateLegacyState(state []byte) (*State, error) {
@@ -22,9 +50,20 @@ func migrateLegacyState(state []byte) (*State, error) {
 		return nil, fmt.Errorf("no latest revision found")
 	}
 
-	return &State{
+	st := &State{
 		Container: latest.State,
-	}, nil
+	}
+	for _, revision := range history {
+		st.History = append(st.History, &Revision{
+			Version:     revision.Version,
+			Name:        revision.Name,
+			Explanation: revision.Explanation,
+			Output:      revision.Output,
+			CreatedAt:   revision.CreatedAt,
+			State:       revision.State,
+		})
+	}
+	return st, nil
 }
 
 type legacyState []*legacyRevision
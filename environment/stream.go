@@ -0,0 +1,169 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dagger.io/dagger"
+)
+
+// runOutputDir is where the output of a command is copied while it runs, to
+// stream it to RunOpts.Stdout and RunOpts.Stderr: the engine only returns
+// the output of an exec once it completed.
+const runOutputDir = "/.cu/output"
+
+// outputStream follows the output of a running command.
+type outputStream struct {
+	env    *Environment
+	name   string
+	stdout io.Writer
+	stderr io.Writer
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+	// missed are the streams that weren't copied, e.g. "out"
+	missed []string
+}
+
+func (env *Environment) newOutputStream(opts RunOpts) *outputStream {
+	return &outputStream{
+		env:    env,
+		name:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		stdout: opts.Stdout,
+		stderr: opts.Stderr,
+		stop:   make(chan struct{}),
+	}
+}
+
+// wrap copies the output of the script to the output volume, mounted on the
+// container. The script runs unchanged if the image lacks mkfifo or tee. Its
+// positional parameters are passed on, see RunArgs.
+func (s *outputStream) wrap(container *dagger.Container, script string) (*dagger.Container, string) {
+	prefix := path.Join(runOutputDir, s.name)
+	wrapped := &strings.Builder{}
+	fmt.Fprintf(wrapped, "cu_command() (\n%s\n)\n", script)
+	wrapped.WriteString("if command -v mkfifo >/dev/null 2>&1 && command -v tee >/dev/null 2>&1 && mkfifo")
+	redirects := ""
+	if s.stdout != nil {
+		fmt.Fprintf(wrapped, " %s.out.pipe", prefix)
+		redirects += fmt.Sprintf(" >%s.out.pipe", prefix)
+	}
+	if s.stderr != nil {
+		fmt.Fprintf(wrapped, " %s.err.pipe", prefix)
+		redirects += fmt.Sprintf(" 2>%s.err.pipe", prefix)
+	}
+	wrapped.WriteString("; then\n")
+	if s.stdout != nil {
+		fmt.Fprintf(wrapped, "tee %[1]s.out <%[1]s.out.pipe &\n", prefix)
+	}
+	if s.stderr != nil {
+		fmt.Fprintf(wrapped, "tee %[1]s.err <%[1]s.err.pipe >&2 &\n", prefix)
+	}
+	// Wait for tee to write the end of the output before exiting
+	fmt.Fprintf(wrapped, "cu_command \"$@\"%s\ncode=$?\nwait\nrm -f %[2]s.out.pipe %[2]s.err.pipe\nexit $code\nfi\ncu_command \"$@\"", redirects, prefix)
+	return container.WithMountedCache(runOutputDir, s.env.client().CacheVolume(backgroundLogsVolume(s.env.ID))), wrapped.String()
+}
+
+// start follows the output until wait is called, redacting the secrets.
+func (s *outputStream) start(ctx context.Context, secrets map[string]string) {
+	for ext, w := range map[string]io.Writer{"out": s.stdout, "err": s.stderr} {
+		if w == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			copied, err := s.follow(ctx, s.name+"."+ext, w, secrets)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.err = errors.Join(s.err, err)
+			if err == nil && !copied {
+				s.missed = append(s.missed, ext)
+			}
+		}()
+	}
+}
+
+// wait writes the rest of the output once the command completed. It returns
+// the writers of the output that wasn't copied, to write it as a whole.
+func (s *outputStream) wait() (stdout, stderr io.Writer, err error) {
+	close(s.stop)
+	s.wg.Wait()
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	for _, ext := range s.missed {
+		if ext == "out" {
+			stdout = s.stdout
+		} else {
+			stderr = s.stderr
+		}
+	}
+	return stdout, stderr, nil
+}
+
+// follow writes the complete lines appended to the file, so that a secret
+// isn't split between two reads, and the rest of the file once stopped. It
+// reports whether the file was found.
+func (s *outputStream) follow(ctx context.Context, name string, w io.Writer, secrets map[string]string) (bool, error) {
+	offset := 0
+	for {
+		var stopped bool
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-s.stop:
+			stopped = true
+		case <-time.After(backgroundPollRate):
+		}
+
+		output, found, err := s.read(ctx, name, offset, stopped)
+		if err != nil {
+			return false, err
+		}
+		if !stopped {
+			output = output[:strings.LastIndex(output, "\n")+1]
+		}
+		if _, err := io.WriteString(w, redact(output, secrets)); err != nil {
+			return false, fmt.Errorf("failed to write the output: %w", err)
+		}
+		offset += len(output)
+		if stopped {
+			return found || offset > 0, nil
+		}
+	}
+}
+
+// read returns the file of the volume from offset, and whether it exists.
+// The last read removes the file.
+func (s *outputStream) read(ctx context.Context, name string, offset int, last bool) (string, bool, error) {
+	script := `[ -e "$2" ] || exit 3
+tail -c "+$1" "$2"`
+	if last {
+		script += ` && rm -f "$2"`
+	}
+	output, err := s.env.client().Container().
+		From(alpineImage).
+		WithMountedCache(runOutputDir, s.env.client().CacheVolume(backgroundLogsVolume(s.env.ID))).
+		// The file keeps changing: never reuse a previous read
+		WithEnvVariable("CU_CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", script, "sh", strconv.Itoa(offset + 1), path.Join(runOutputDir, name)}).
+		Stdout(ctx)
+	if err != nil {
+		var exitErr *dagger.ExecError
+		if errors.As(err, &exitErr) && exitErr.ExitCode == 3 {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return output, true, nil
+}
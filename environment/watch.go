@@ -0,0 +1,160 @@
+package environment
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the source must stay unchanged before syncing,
+// so that a burst of writes (e.g. a checkout) results in a single revision.
+const watchDebounce = time.Second
+
+// Watch watches the host source directory for changes and copies the changed
+// files into the container workdir, creating a revision and calling onChange
+// after each sync. It stops when ctx is done or the returned stop function is
+// called. The repository persists the syncs, see Repository.Watch.
+func (env *Environment) Watch(ctx context.Context, onChange func()) (func(), error) {
+	if env.Source == "" {
+		return nil, errors.New("the environment has no source directory to watch")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// dirs are the watched directories, relative to the source
+	dirs := map[string]bool{}
+	if err := watchTree(watcher, env.Source, ".", dirs); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer watcher.Close()
+
+		pending := map[string]bool{}
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Failed to watch the source", "environment", env.ID, "source", env.Source, "err", err)
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				rel, err := filepath.Rel(env.Source, event.Name)
+				if err != nil || slices.Contains(strings.Split(filepath.ToSlash(rel), "/"), ".git") {
+					continue
+				}
+				rel = filepath.ToSlash(rel)
+				if event.Has(fsnotify.Create) {
+					if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+						if err := watchTree(watcher, env.Source, rel, dirs); err != nil {
+							slog.Error("Failed to watch new directory", "environment", env.ID, "dir", event.Name, "err", err)
+						}
+					}
+				}
+				pending[rel] = true
+				debounce.Reset(watchDebounce)
+			case <-debounce.C:
+				changed := slices.Sorted(maps.Keys(pending))
+				pending = map[string]bool{}
+				if err := env.syncFromHost(ctx, changed, dirs); err != nil {
+					slog.Error("Failed to sync the source", "environment", env.ID, "source", env.Source, "err", err)
+				} else if onChange != nil {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+// watchTree adds dir, relative to the source, and its subdirectories to the
+// watcher, skipping .git.
+func watchTree(watcher *fsnotify.Watcher, source, dir string, dirs map[string]bool) error {
+	return filepath.WalkDir(filepath.Join(source, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+		if err := watcher.Add(p); err != nil {
+			return err
+		}
+		dirs[filepath.ToSlash(rel)] = true
+		return nil
+	})
+}
+
+// syncFromHost copies the changed paths, relative to the source, from the host
+// to the workdir. New directories are copied as a whole, since their content
+// may have been written before they were watched.
+func (env *Environment) syncFromHost(ctx context.Context, changed []string, dirs map[string]bool) error {
+	container := env.container
+	for _, name := range changed {
+		target := path.Join(env.Config.Workdir, name)
+		source := filepath.Join(env.Source, filepath.FromSlash(name))
+		info, err := os.Lstat(source)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if dirs[name] {
+				container = container.WithoutDirectory(target)
+				maps.DeleteFunc(dirs, func(dir string, _ bool) bool {
+					return dir == name || strings.HasPrefix(dir, name+"/")
+				})
+			} else {
+				container = container.WithoutFile(target)
+			}
+		case err != nil:
+			return err
+		case info.IsDir():
+			container = container.WithDirectory(target, env.client().Host().Directory(source, dagger.HostDirectoryOpts{
+				Exclude: []string{"**/.git"},
+			}))
+		case info.Mode().IsRegular():
+			container = container.WithFile(target, env.client().Host().File(source))
+		}
+	}
+
+	if err := env.apply(ctx, "Sync "+strings.Join(changed, " "), "Sync changes from the host", "", container); err != nil {
+		return err
+	}
+	env.Notes.Add("Sync from %s\n%s\n\n", env.Source, strings.Join(changed, "\n"))
+	return nil
+}
@@ -7,10 +7,12 @@ toolchain go1.24.4
 require (
 	dagger.io/dagger v0.18.10
 	github.com/dustinkirkland/golang-petname v0.0.0-20240428194347-eebcea082ee0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/mark3labs/mcp-go v0.29.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/spf13/cobra v1.9.1
 	github.com/tiborvass/go-watch v0.0.0-20250607214558-08999a83bf8b
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -7,8 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"strings"
+	"time"
 
+	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
 	"github.com/dagger/container-use/repository"
 	"github.com/dagger/container-use/rules"
@@ -80,6 +83,20 @@ func openEnvironment(ctx context.Context, request mcp.CallToolRequest) (*reposit
 	return repo, env, nil
 }
 
+// openEnvironmentServices is openEnvironment for the operations on services:
+// the ones left running by a previous server are reattached first. Failing to
+// reattach some doesn't fail the operation, they're reported in the notes.
+func openEnvironmentServices(ctx context.Context, request mcp.CallToolRequest) (*repository.Repository, *environment.Environment, error) {
+	repo, env, err := openEnvironment(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := repo.ReattachServices(ctx, env); err != nil {
+		slog.Warn("Failed to reattach background services", "environment", env.ID, "err", err)
+	}
+	return repo, env, nil
+}
+
 type Tool struct {
 	Definition mcp.Tool
 	Handler    server.ToolHandlerFunc
@@ -131,26 +148,32 @@ func init() {
 
 		EnvironmentFileReadTool,
 		EnvironmentFileListTool,
+		EnvironmentFileGlobTool,
 		EnvironmentFileWriteTool,
 		EnvironmentFileDeleteTool,
 
 		EnvironmentAddServiceTool,
+		EnvironmentStopServiceTool,
+		EnvironmentRebindServiceTool,
+		EnvironmentServiceLogsTool,
 
 		EnvironmentCheckpointTool,
+		EnvironmentHistoryTool,
+		EnvironmentDiffTool,
 	)
 }
 
 type EnvironmentResponse struct {
-	ID               string                 `json:"id"`
-	BaseImage        string                 `json:"base_image"`
-	SetupCommands    []string               `json:"setup_commands"`
-	Instructions     string                 `json:"instructions"`
-	Workdir          string                 `json:"workdir"`
-	Branch           string                 `json:"branch"`
-	TrackingBranch   string                 `json:"tracking_branch"`
-	CheckoutCommand  string                 `json:"checkout_command_for_human"`
-	HostWorktreePath string                 `json:"host_worktree_path"`
-	Services         []*environment.Service `json:"services,omitempty"`
+	ID               string   `json:"id"`
+	BaseImage        string   `json:"base_image"`
+	SetupCommands    []string `json:"setup_commands"`
+	Instructions     string   `json:"instructions"`
+	Workdir          string   `json:"workdir"`
+	Branch           string   `json:"branch"`
+	TrackingBranch   string   `json:"tracking_branch"`
+	CheckoutCommand  string   `json:"checkout_command_for_human"`
+	HostWorktreePath string   `json:"host_worktree_path"`
+	*environment.Description
 }
 
 func marshalEnvironment(env *environment.Environment) (string, error) {
@@ -164,7 +187,7 @@ func marshalEnvironment(env *environment.Environment) (string, error) {
 		TrackingBranch:   fmt.Sprintf("container-use/%s", env.ID),
 		CheckoutCommand:  fmt.Sprintf("git checkout %s", env.ID),
 		HostWorktreePath: env.Worktree,
-		Services:         env.Services,
+		Description:      env.Describe(),
 	}
 	out, err := json.Marshal(resp)
 	if err != nil {
@@ -223,6 +246,9 @@ DO NOT manually install toolchains inside the environment, instead explicitly ca
 			mcp.Description("Name of the environment. Use hyphens (-) to separate words, no spaces or underscores allowed (e.g., 'my-web-app' not 'my web app' or 'my_web_app')"),
 			mcp.Required(),
 		),
+		mcp.WithBoolean("reuse",
+			mcp.Description("Return an existing environment with the same name created from the same source state instead of building a new one. Defaults to false."),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, err := openRepository(ctx, request)
@@ -237,7 +263,9 @@ DO NOT manually install toolchains inside the environment, instead explicitly ca
 			return mcp.NewToolResultErrorFromErr("invalid name", err), nil
 		}
 
-		env, err := repo.Create(ctx, name, request.GetString("explanation", ""))
+		env, err := repo.Create(ctx, name, request.GetString("explanation", ""), repository.CreateOpts{
+			Reuse: request.GetBool("reuse", false),
+		})
 		if err != nil {
 			return mcp.NewToolResultErrorFromErr("failed to create environment", err), nil
 		}
@@ -266,6 +294,9 @@ var EnvironmentUpdateTool = &Tool{
 			mcp.Description("The instructions for the environment. This should contain any information that might be useful to operate in the environment, such as what tools are available, what commands to use to build/test/etc"),
 			mcp.Required(),
 		),
+		mcp.WithBoolean("sync_instructions",
+			mcp.Description("Also write the instructions to AGENT.md at the root of the source, so that they're merged back with the changes. Remembered for later updates."),
+		),
 
 		mcp.WithString("base_image",
 			mcp.Description("Change the base image for the environment."),
@@ -281,6 +312,9 @@ var EnvironmentUpdateTool = &Tool{
 			mcp.Required(),
 			mcp.Items(map[string]any{"type": "string"}),
 		),
+		mcp.WithBoolean("expand_envs",
+			mcp.Description("Expand references to existing variables in env values (e.g. `PATH=$PATH:/opt/bin`). Values are stored literally by default. Unchanged when omitted."),
+		),
 		mcp.WithArray("secrets",
 			mcp.Description(`Secret references in the format of "SECRET_NAME=schema://value
 
@@ -294,6 +328,13 @@ Supported schemas are:
 			mcp.Required(),
 			mcp.Items(map[string]any{"type": "string"}),
 		),
+		mcp.WithString("dockerfile",
+			mcp.Description("Contents of a Dockerfile to build the environment from, instead of the base image. The build context is the source repository. Unchanged when omitted: pass an empty string to build from the base image again."),
+		),
+		mcp.WithArray("build_args",
+			mcp.Description("Build arguments for the Dockerfile (e.g. `[\"GO_VERSION=1.24\"]`). Changing a build argument only rebuilds the instructions using it. Unchanged when omitted."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		repo, env, err := openEnvironment(ctx, request)
@@ -308,6 +349,7 @@ Supported schemas are:
 			return nil, err
 		}
 		config.Instructions = instructions
+		config.SyncInstructions = request.GetBool("sync_instructions", config.SyncInstructions)
 
 		baseImage, err := request.RequireString("base_image")
 		if err != nil {
@@ -326,6 +368,7 @@ Supported schemas are:
 			return nil, err
 		}
 		config.Env = envs
+		config.ExpandEnv = request.GetBool("expand_envs", config.ExpandEnv)
 
 		secrets, err := request.RequireStringSlice("secrets")
 		if err != nil {
@@ -333,6 +376,9 @@ Supported schemas are:
 		}
 		config.Secrets = secrets
 
+		config.Dockerfile = request.GetString("dockerfile", config.Dockerfile)
+		config.BuildArgs = request.GetStringSlice("build_args", config.BuildArgs)
+
 		if err := env.UpdateConfig(ctx, request.GetString("explanation", ""), config); err != nil {
 			return mcp.NewToolResultErrorFromErr("unable to update the environment", err), nil
 		}
@@ -407,8 +453,79 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 			mcp.Description("Use the image entrypoint, if present, by prepending it to the args."),
 		),
 		mcp.WithArray("ports",
-			mcp.Description("Ports to expose. Only works with background environments. For each port, returns the internal (for use by other environments) and external (for use by the user) address."),
-			mcp.Items(map[string]any{"type": "number"}),
+			mcp.Description("Ports to expose. Only works with background environments. For each port, returns the internal (for use by other environments) and external (for use by the user) address. Use 0 to auto-allocate a port, passed to the command as $PORT. Ports are TCP unless given as a string with a protocol, e.g. `\"53/udp\"`."),
+			mcp.Items(map[string]any{"type": []string{"number", "string"}}),
+		),
+		mcp.WithArray("host_ports",
+			mcp.Description("Host ports to expose ports on, as `HOST:CONTAINER` (e.g. `[\"8080:3000\"]`), for stable URLs. Other ports get a random host port. Fails if a host port is already in use. Only works with background commands."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithBoolean("detect_port",
+			mcp.Description("Expose the port the background command announces in its output (e.g. `http://localhost:3000`) instead of explicit ports. The command must listen on all interfaces."),
+		),
+		mcp.WithBoolean("tls",
+			mcp.Description("Serve the external endpoints over HTTPS with a self-signed certificate, returned with the endpoints for clients to trust. Only works with background commands."),
+		),
+		mcp.WithBoolean("restart_on_change",
+			mcp.Description("Restart the background command with the new files whenever the environment changes, for hot reloading. Only works with background commands."),
+		),
+		mcp.WithArray("envs",
+			mcp.Description("Environment variables for this background command only (e.g. `[\"DATABASE_URL=postgres://db:5432\"]`). Only works with background commands."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("service_name",
+			mcp.Description("Name of the background service, unique within the environment, to refer to it later. Only works with background commands."),
+		),
+		mcp.WithString("wait_for_log",
+			mcp.Description("Regular expression matching the log line printed by the command once it's ready (e.g. `Listening on`). The tool waits for it before returning. Only works with background commands."),
+		),
+		mcp.WithBoolean("expose_on_host",
+			mcp.Description("Expose the ports on the host (default: true). If the host can't be reached, only internal addresses are returned. Only works with background commands."),
+		),
+		mcp.WithBoolean("probe_health",
+			mcp.Description("Probe common health paths (/health, /healthz, /) on the exposed ports and report which one responded. Only works with background commands."),
+		),
+		mcp.WithArray("secrets",
+			mcp.Description("Secret values available to this command only, as environment variables (e.g. `[\"API_KEY=value\"]`). They are never stored and are redacted from the output."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithArray("args",
+			mcp.Description("Values for the `{{name}}` placeholders of the command, e.g. `[\"file=my report.txt\"]` for `wc -l {{file}}`. Values are quoted safely for the shell, so placeholders must not be quoted in the command. Use it for file names and any value with spaces or special characters."),
+			mcp.Items(map[string]any{"type": "string"}),
+		),
+		mcp.WithString("label",
+			mcp.Description("Label recorded on the version created by the command, to find it later in the history (e.g. `tests`). Ignored for background commands."),
+		),
+		mcp.WithString("workdir",
+			mcp.Description("Directory to run the command in, absolute or relative to the workdir, for this command only. Ignored for background commands."),
+		),
+		mcp.WithBoolean("reproducible",
+			mcp.Description("Run with a fixed SOURCE_DATE_EPOCH, the UTC time zone and the C locale, for deterministic build artifacts. Ignored for background commands."),
+		),
+		mcp.WithNumber("timeout",
+			mcp.Description("Fail the command if it runs for longer than this many seconds. Ignored for background commands."),
+		),
+		mcp.WithBoolean("expect_json",
+			mcp.Description("Fail if the output of the command isn't valid JSON, e.g. when it printed an error instead. Ignored for background commands."),
+		),
+		mcp.WithBoolean("commit_workdir",
+			mcp.Description("Commit the changes made by the command to the git repository of the workdir inside the container, with the command as message. Ignored for background commands."),
+		),
+		mcp.WithString("assert",
+			mcp.Description("Command to run after the command succeeded to verify it (e.g. the tests after a build). The result fails if it fails, and its changes aren't kept. Ignored for background commands."),
+		),
+		mcp.WithBoolean("detect_outside_changes",
+			mcp.Description("Report the files the command changed outside the workdir (e.g. in /etc or /usr). Diffing the filesystem is slow, only use it when the effects of the command are unclear. Ignored for background commands."),
+		),
+		mcp.WithString("stdin",
+			mcp.Description("Data to feed to the command's standard input (e.g. a patch for `patch -p1`). Ignored for background commands."),
+		),
+		mcp.WithNumber("stdin_from_version",
+			mcp.Description("Feed the output of a previous version of the environment to the command's standard input."),
+		),
+		mcp.WithArray("allowed_hosts",
+			mcp.Description("Only let the command reach these hosts over HTTP(S) (e.g. `[\"proxy.golang.org\", \"*.github.com\"]`). The filtering is advisory, not a security boundary: it goes through http_proxy/https_proxy, so only tools honoring these variables are restricted, and other connections are not blocked. Ignored for background commands."),
+			mcp.Items(map[string]any{"type": "string"}),
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
@@ -419,6 +536,19 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 
 		command := request.GetString("command", "")
 		shell := request.GetString("shell", "sh")
+		if templateArgs := request.GetStringSlice("args", nil); len(templateArgs) > 0 {
+			args := map[string]string{}
+			for _, arg := range templateArgs {
+				k, v, found := strings.Cut(arg, "=")
+				if !found {
+					return mcp.NewToolResultError(fmt.Sprintf("invalid argument: %s", k)), nil
+				}
+				args[k] = v
+			}
+			if command, err = environment.RenderCommandTemplate(command, args); err != nil {
+				return mcp.NewToolResultErrorFromErr("invalid command template", err), nil
+			}
+		}
 
 		updateRepo := func() (*mcp.CallToolResult, error) {
 			if err := repo.Update(ctx, env, "Run "+command, request.GetString("explanation", "")); err != nil {
@@ -427,49 +557,137 @@ Failure to do so will result in the tool being stuck, awaiting for the command t
 			return nil, nil
 		}
 
+		secrets := map[string]string{}
+		for _, secret := range request.GetStringSlice("secrets", []string{}) {
+			k, v, found := strings.Cut(secret, "=")
+			if !found {
+				return mcp.NewToolResultError(fmt.Sprintf("invalid secret: %s", k)), nil
+			}
+			secrets[k] = v
+		}
+
 		background := request.GetBool("background", false)
 		if background {
-			ports := []int{}
-			if portList, ok := request.GetArguments()["ports"].([]any); ok {
-				for _, port := range portList {
-					ports = append(ports, int(port.(float64)))
+			// Service names must stay unique with the ones left running
+			if err := repo.ReattachServices(ctx, env); err != nil {
+				slog.Warn("Failed to reattach background services", "environment", env.ID, "err", err)
+			}
+			ports, protocols, err := parsePorts(request.GetArguments()["ports"])
+			if err != nil {
+				return mcp.NewToolResultErrorFromErr("invalid ports", err), nil
+			}
+			hostPorts := map[int]int{}
+			for _, mapping := range request.GetStringSlice("host_ports", []string{}) {
+				host, container, found := strings.Cut(mapping, ":")
+				hostPort, hostErr := strconv.Atoi(host)
+				port, portErr := strconv.Atoi(container)
+				if !found || hostErr != nil || portErr != nil {
+					return mcp.NewToolResultError(fmt.Sprintf("invalid host port mapping %q, expected HOST:CONTAINER", mapping)), nil
 				}
+				hostPorts[port] = hostPort
 			}
-			endpoints, runErr := env.RunBackground(ctx, request.GetString("explanation", ""), command, shell, ports, request.GetBool("use_entrypoint", false))
+			service, runErr := env.RunBackground(ctx, request.GetString("explanation", ""), command, shell, ports, environment.RunBackgroundOpts{
+				UseEntrypoint:   request.GetBool("use_entrypoint", false),
+				ProbeHealth:     request.GetBool("probe_health", false),
+				ExposeOnHost:    request.GetBool("expose_on_host", true),
+				WaitForLog:      request.GetString("wait_for_log", ""),
+				Name:            request.GetString("service_name", ""),
+				Env:             request.GetStringSlice("envs", []string{}),
+				Secrets:         secrets,
+				DetectPort:      request.GetBool("detect_port", false),
+				RestartOnChange: request.GetBool("restart_on_change", false),
+				TLS:             request.GetBool("tls", false),
+				Protocols:       protocols,
+				HostPorts:       hostPorts,
+			})
 			// We want to update the repository even if the command failed.
 			if resp, err := updateRepo(); err != nil {
 				return resp, nil
 			}
 			if runErr != nil {
-				return mcp.NewToolResultErrorFromErr("failed to run command", err), nil
+				return mcp.NewToolResultErrorFromErr("failed to run command", runErr), nil
 			}
 
-			out, err := json.Marshal(endpoints)
+			out, err := json.Marshal(service.Endpoints)
 			if err != nil {
 				return nil, err
 			}
 
-			return mcp.NewToolResultText(fmt.Sprintf(`Command started in the background. Endpoints are %s
+			ready := ""
+			if service.ReadyLog != "" {
+				ready = fmt.Sprintf("\nReady: %s\n", service.ReadyLog)
+			}
 
+			return mcp.NewToolResultText(fmt.Sprintf(`Command started in the background. Endpoints are %s
+%s
 Any changes to the container workdir (%s) WILL NOT be committed to container-use/%s
 
 Background commands are unaffected by filesystem and any other kind of changes. You need to start a new command for changes to take effect.`,
-				string(out), env.Config.Workdir, env.ID)), nil
+				string(out), ready, env.Config.Workdir, env.ID)), nil
 		}
 
-		stdout, runErr := env.Run(ctx, request.GetString("explanation", ""), command, shell, request.GetBool("use_entrypoint", false))
+		result, runErr := env.Run(ctx, request.GetString("explanation", ""), command, shell, environment.RunOpts{
+			UseEntrypoint:        request.GetBool("use_entrypoint", false),
+			Secrets:              secrets,
+			AllowedHosts:         request.GetStringSlice("allowed_hosts", nil),
+			StdinFromVersion:     request.GetInt("stdin_from_version", 0),
+			Stdin:                request.GetString("stdin", ""),
+			Label:                request.GetString("label", ""),
+			CommitWorkdir:        request.GetBool("commit_workdir", false),
+			ExpectJSON:           request.GetBool("expect_json", false),
+			Workdir:              request.GetString("workdir", ""),
+			Reproducible:         request.GetBool("reproducible", false),
+			Timeout:              time.Duration(request.GetFloat("timeout", 0) * float64(time.Second)),
+			DetectOutsideChanges: request.GetBool("detect_outside_changes", false),
+			Assert:               request.GetString("assert", ""),
+		})
 		// We want to update the repository even if the command failed.
 		if resp, err := updateRepo(); err != nil {
 			return resp, nil
 		}
+		if runErr != nil && result != nil {
+			// The command ran but its output isn't what was expected
+			return mcp.NewToolResultError(fmt.Sprintf("%s\n\nstdout:\n%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/%s", runErr, result.Stdout, env.Config.Workdir, env.ID)), nil
+		}
 		if runErr != nil {
-			return mcp.NewToolResultErrorFromErr("failed to run command", err), nil
+			return mcp.NewToolResultErrorFromErr("failed to run command", runErr), nil
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/%s", stdout, env.Config.Workdir, env.ID)), nil
+		return mcp.NewToolResultText(fmt.Sprintf("%s\n\nAny changes to the container workdir (%s) have been committed and pushed to container-use/%s", result, env.Config.Workdir, env.ID)), nil
 	},
 }
 
+// parsePorts parses ports given as numbers, or as strings with an optional
+// protocol such as "53/udp".
+func parsePorts(arg any) ([]int, map[int]dagger.NetworkProtocol, error) {
+	ports := []int{}
+	protocols := map[int]dagger.NetworkProtocol{}
+	portList, _ := arg.([]any)
+	for _, port := range portList {
+		switch port := port.(type) {
+		case float64:
+			ports = append(ports, int(port))
+		case string:
+			number, protocol, _ := strings.Cut(port, "/")
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid port %q", port)
+			}
+			ports = append(ports, n)
+			switch strings.ToLower(protocol) {
+			case "", "tcp":
+			case "udp":
+				protocols[n] = dagger.NetworkProtocolUdp
+			default:
+				return nil, nil, fmt.Errorf("unsupported protocol %q, expected tcp or udp", protocol)
+			}
+		default:
+			return nil, nil, fmt.Errorf("invalid port %v", port)
+		}
+	}
+	return ports, protocols, nil
+}
+
 var EnvironmentFileReadTool = &Tool{
 	Definition: mcp.NewTool("environment_file_read",
 		mcp.WithDescription("Read the contents of a file, specifying a line range or the entire file."),
@@ -560,6 +778,45 @@ var EnvironmentFileListTool = &Tool{
 	},
 }
 
+var EnvironmentFileGlobTool = &Tool{
+	Definition: mcp.NewTool("environment_file_glob",
+		mcp.WithDescription("Find the files matching a glob pattern, without reading them."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these files are being searched."),
+		),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("pattern",
+			mcp.Description("Glob pattern, absolute or relative to the workdir. `**` matches any number of directories (e.g. `**/*_test.go`)."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		_, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+
+		pattern, err := request.RequireString("pattern")
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := env.Glob(ctx, pattern)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to match files", err), nil
+		}
+
+		return mcp.NewToolResultText(strings.Join(matches, "\n")), nil
+	},
+}
+
 var EnvironmentFileWriteTool = &Tool{
 	Definition: mcp.NewTool("environment_file_write",
 		mcp.WithDescription("Write the contents of a file."),
@@ -685,6 +942,103 @@ var EnvironmentCheckpointTool = &Tool{
 	},
 }
 
+var EnvironmentHistoryTool = &Tool{
+	Definition: mcp.NewTool("environment_history",
+		mcp.WithDescription("Show the history of the operations performed in an environment, one page at a time."),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("offset",
+			mcp.Description("Offset of the first revision to return (default: 0)."),
+		),
+		mcp.WithNumber("limit",
+			mcp.Description("Maximum number of revisions to return (default: 20)."),
+		),
+		mcp.WithString("label",
+			mcp.Description("Only return the revisions of the commands run with this label. Ignores offset and limit."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		_, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+
+		var page *environment.HistoryPage
+		if label := request.GetString("label", ""); label != "" {
+			revisions := env.History.FindByLabel(label)
+			page = &environment.HistoryPage{Revisions: revisions, Total: len(revisions)}
+		} else if page, err = env.HistoryPage(request.GetInt("offset", 0), request.GetInt("limit", 20)); err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to get history", err), nil
+		}
+
+		out := &strings.Builder{}
+		for _, revision := range page.Revisions {
+			fmt.Fprintf(out, "%d. %s (%s)\n", revision.Version, revision.Name, revision.CreatedAt.Format(time.RFC3339))
+			if revision.Label != "" {
+				fmt.Fprintf(out, "   label: %s\n", revision.Label)
+			}
+			if revision.Explanation != "" {
+				fmt.Fprintf(out, "   %s\n", revision.Explanation)
+			}
+		}
+		fmt.Fprintf(out, "\n%d revisions in total.", page.Total)
+		if page.NextOffset != 0 {
+			fmt.Fprintf(out, " Use offset %d for the next page.", page.NextOffset)
+		}
+		return mcp.NewToolResultText(out.String()), nil
+	},
+}
+
+var EnvironmentDiffTool = &Tool{
+	Definition: mcp.NewTool("environment_diff",
+		mcp.WithDescription("Show the changes made to the workdir between two versions of an environment, as listed by `environment_history`."),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("from_version",
+			mcp.Description("Version to compare from."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("to_version",
+			mcp.Description("Version to compare to (default: the latest version)."),
+		),
+		mcp.WithString("format",
+			mcp.Description("Output format: `unified` (default, a patch), `summary` (one line per changed file) or `json`."),
+			mcp.Enum("unified", "summary", "json"),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		_, env, err := openEnvironment(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+		fromVersion, err := request.RequireInt("from_version")
+		if err != nil {
+			return nil, err
+		}
+
+		diff, err := env.Diff(ctx, fromVersion, request.GetInt("to_version", env.History.LatestVersion()), request.GetString("format", "unified"))
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to diff versions", err), nil
+		}
+		if diff == "" {
+			return mcp.NewToolResultText("No changes."), nil
+		}
+		return mcp.NewToolResultText(diff), nil
+	},
+}
+
 var EnvironmentAddServiceTool = &Tool{
 	Definition: mcp.NewTool("environment_add_service",
 		mcp.WithDescription("Add a service to the environment (e.g. database, cache, etc.)"),
@@ -732,7 +1086,7 @@ Supported schemas are:
 		),
 	),
 	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		repo, env, err := openEnvironment(ctx, request)
+		repo, env, err := openEnvironmentServices(ctx, request)
 		if err != nil {
 			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
 		}
@@ -779,3 +1133,160 @@ Supported schemas are:
 		return mcp.NewToolResultText(fmt.Sprintf("Service added and started successfully: %s", string(output))), nil
 	},
 }
+
+var EnvironmentStopServiceTool = &Tool{
+	Definition: mcp.NewTool("environment_stop_service",
+		mcp.WithDescription("Stop a background command started with `environment_run_cmd` and release its host ports."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this service is being stopped."),
+		),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("service",
+			mcp.Description("The ID or name of the background service to stop."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, env, err := openEnvironmentServices(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+		serviceID, err := request.RequireString("service")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := env.StopBackground(ctx, serviceID); err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to stop service", err), nil
+		}
+
+		if err := repo.Update(ctx, env, "Stop service "+serviceID, request.GetString("explanation", "")); err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to update env", err), nil
+		}
+
+		output, err := json.Marshal(env.BackgroundServices())
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to marshal services", err), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Service %s stopped. Background services still running: %s", serviceID, string(output))), nil
+	},
+}
+
+var EnvironmentRebindServiceTool = &Tool{
+	Definition: mcp.NewTool("environment_rebind_service",
+		mcp.WithDescription("Move a background command started with `environment_run_cmd` to another port, e.g. after it was reconfigured to listen elsewhere. The service is restarted with the new port exposed and its external endpoint stays the same. Services started with detected ports are rebound automatically when they restart on another port."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why this service is being rebound."),
+		),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("service",
+			mcp.Description("The ID or name of the background service to rebind."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("from_port",
+			mcp.Description("The port the service was exposed on."),
+			mcp.Required(),
+		),
+		mcp.WithNumber("to_port",
+			mcp.Description("The port the command now listens on."),
+			mcp.Required(),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, env, err := openEnvironmentServices(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+		serviceID, err := request.RequireString("service")
+		if err != nil {
+			return nil, err
+		}
+		from, err := request.RequireInt("from_port")
+		if err != nil {
+			return nil, err
+		}
+		to, err := request.RequireInt("to_port")
+		if err != nil {
+			return nil, err
+		}
+
+		endpoint, err := env.RebindService(ctx, serviceID, from, to)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to rebind service", err), nil
+		}
+
+		if err := repo.Update(ctx, env, "Rebind service "+serviceID, request.GetString("explanation", "")); err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to update env", err), nil
+		}
+
+		output, err := json.Marshal(endpoint)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to marshal endpoint", err), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Service %s rebound from port %d to %d: %s", serviceID, from, to, string(output))), nil
+	},
+}
+
+var EnvironmentServiceLogsTool = &Tool{
+	Definition: mcp.NewTool("environment_service_logs",
+		mcp.WithDescription("Read the output of a background command started with `environment_run_cmd` so far."),
+		mcp.WithString("explanation",
+			mcp.Description("One sentence explanation for why these logs are being read."),
+		),
+		mcp.WithString("environment_source",
+			mcp.Description("Absolute path to the source git repository for the environment."),
+			mcp.Required(),
+		),
+		mcp.WithString("environment_id",
+			mcp.Description("The ID of the environment for this command. Must call `environment_create` first."),
+			mcp.Required(),
+		),
+		mcp.WithString("service",
+			mcp.Description("The ID or name of the background service."),
+			mcp.Required(),
+		),
+		mcp.WithBoolean("record",
+			mcp.Description("Record the logs in the environment history."),
+		),
+	),
+	Handler: func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		repo, env, err := openEnvironmentServices(ctx, request)
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("unable to open the environment", err), nil
+		}
+		serviceID, err := request.RequireString("service")
+		if err != nil {
+			return nil, err
+		}
+
+		record := request.GetBool("record", false)
+		logs, err := env.BackgroundLogs(ctx, serviceID, environment.BackgroundLogsOpts{Record: record})
+		if err != nil {
+			return mcp.NewToolResultErrorFromErr("failed to read logs", err), nil
+		}
+
+		if record {
+			if err := repo.Update(ctx, env, "Logs of service "+serviceID, request.GetString("explanation", "")); err != nil {
+				return mcp.NewToolResultErrorFromErr("failed to update env", err), nil
+			}
+		}
+
+		return mcp.NewToolResultText(logs), nil
+	},
+}
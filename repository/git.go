@@ -2,8 +2,11 @@ package repository
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/url"
 	"os"
@@ -20,6 +23,7 @@ import (
 
 const (
 	maxFileSizeForTextCheck = 10 * 1024 * 1024 // 10MB
+	cacheKeyConfig          = "container-use-cache-key"
 )
 
 var (
@@ -97,6 +101,76 @@ func (r *Repository) deleteLocalRemoteBranch(id string) error {
 	return nil
 }
 
+// sourceCacheKey hashes everything an environment is built from: the name, the
+// current commit and any uncommitted changes (which include the configuration),
+// untracked files included.
+func (r *Repository) sourceCacheKey(ctx context.Context, name string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintln(h, name)
+	for _, args := range [][]string{
+		{"rev-parse", "HEAD"},
+		{"status", "--porcelain"},
+		{"diff", "HEAD"},
+	} {
+		out, err := runGitCommand(ctx, r.userRepoPath, args...)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, out)
+	}
+
+	// status only lists the untracked files, not their contents
+	untracked, err := runGitCommand(ctx, r.userRepoPath, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Split(strings.TrimSuffix(untracked, "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		f, err := os.Open(filepath.Join(r.userRepoPath, name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(h, name)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (r *Repository) setCacheKey(ctx context.Context, id, key string) error {
+	_, err := runGitCommand(ctx, r.forkRepoPath, "config", fmt.Sprintf("branch.%s.%s", id, cacheKeyConfig), key)
+	return err
+}
+
+func (r *Repository) findByCacheKey(ctx context.Context, key string) (string, error) {
+	out, err := runGitCommand(ctx, r.forkRepoPath, "config", "--get-regexp", fmt.Sprintf(`^branch\..*\.%s$`, cacheKeyConfig))
+	if err != nil {
+		// git config exits with 1 when no key matches
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+
+	for line := range strings.Lines(out) {
+		k, v, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if v != key {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(k, "branch."), "."+cacheKeyConfig)
+		if err := r.exists(ctx, id); err == nil {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
 func (r *Repository) initializeWorktree(ctx context.Context, id string) (string, error) {
 	worktreePath, err := worktreePath(id)
 	if err != nil {
@@ -161,6 +235,29 @@ func (r *Repository) initializeWorktree(ctx context.Context, id string) (string,
 	return worktreePath, nil
 }
 
+// initializeForkWorktree creates the worktree of a fork, branching off the
+// parent environment instead of the current branch of the source repository.
+func (r *Repository) initializeForkWorktree(ctx context.Context, id, parentID string) (string, error) {
+	worktreePath, err := worktreePath(id)
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("Initializing fork worktree", "repository", r.userRepoPath, "container-id", id, "parent", parentID)
+	if _, err := runGitCommand(ctx, r.forkRepoPath, "worktree", "add", "-b", id, worktreePath, parentID); err != nil {
+		return "", err
+	}
+
+	if _, err := runGitCommand(ctx, r.userRepoPath, "fetch", containerUseRemote, id); err != nil {
+		return "", err
+	}
+	if _, err := runGitCommand(ctx, r.userRepoPath, "branch", "--track", id, fmt.Sprintf("%s/%s", containerUseRemote, id)); err != nil {
+		return "", err
+	}
+
+	return worktreePath, nil
+}
+
 func (r *Repository) propagateToWorktree(ctx context.Context, env *environment.Environment, name, explanation string) (rerr error) {
 	slog.Info("Propagating to worktree...",
 		"environment.id", env.ID,
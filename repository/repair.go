@@ -0,0 +1,193 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dagger/container-use/environment"
+)
+
+// repaired holds a *sync.Once per repository, to repair its environments once
+// per process, see Repair.
+var repaired sync.Map
+
+// repairOnce repairs the environments the first time the repository is opened
+// in this process, logging what it fixed.
+func (r *Repository) repairOnce(ctx context.Context) {
+	once, _ := repaired.LoadOrStore(r.userRepoPath, &sync.Once{})
+	once.(*sync.Once).Do(func() {
+		fixes, err := r.Repair(ctx)
+		for _, fix := range fixes {
+			slog.Warn("Repaired environment", "repository", r.userRepoPath, "fix", fix)
+		}
+		if err != nil {
+			slog.Warn("Failed to repair environments", "repository", r.userRepoPath, "err", err)
+		}
+	})
+}
+
+// Repair reconciles the environments left inconsistent by an interrupted
+// operation, e.g. a Create or Delete that crashed mid-way, and returns what it
+// fixed:
+//   - the worktree of an environment whose branch doesn't exist is removed
+//   - a worktree directory that isn't a git worktree is created again
+//   - an environment without state is rebuilt from its configuration, when
+//     an engine is available
+//
+// It only acts on what git reports as missing: anything it fails to check is
+// left as is and returned as an error. Open repairs the environments the
+// first time a repository is opened in the process.
+func (r *Repository) Repair(ctx context.Context) ([]string, error) {
+	fixes := []string{}
+	var errs []error
+
+	orphans, err := r.orphanWorktrees(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for id, worktree := range orphans {
+		// Not deleteWorktree, which prints to stdout, the MCP transport
+		if err := os.RemoveAll(worktree); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fixes = append(fixes, fmt.Sprintf("removed the worktree of environment %s, which has no branch", id))
+	}
+	if len(orphans) > 0 {
+		if _, err := runGitCommand(ctx, r.forkRepoPath, "worktree", "prune"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	ids, err := r.List(ctx)
+	if err != nil {
+		return fixes, errors.Join(append(errs, err)...)
+	}
+	for _, id := range ids {
+		ephemeralMu.Lock()
+		_, ephemeral := ephemeralEnvironments[id]
+		ephemeralMu.Unlock()
+		if ephemeral {
+			continue
+		}
+		envFixes, err := r.repairEnvironment(ctx, id)
+		fixes = append(fixes, envFixes...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to repair environment %s: %w", id, err))
+		}
+	}
+	return fixes, errors.Join(errs...)
+}
+
+func (r *Repository) repairEnvironment(ctx context.Context, id string) ([]string, error) {
+	fixes := []string{}
+	worktree, err := worktreePath(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(worktree); errors.Is(err, fs.ErrNotExist) {
+		// Get creates the worktree when the environment is loaded
+		return fixes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(worktree, ".git")); errors.Is(err, fs.ErrNotExist) {
+		if err := os.RemoveAll(worktree); err != nil {
+			return nil, err
+		}
+		if _, err := runGitCommand(ctx, r.forkRepoPath, "worktree", "prune"); err != nil {
+			return nil, err
+		}
+		if _, err := r.initializeWorktree(ctx, id); err != nil {
+			return nil, err
+		}
+		fixes = append(fixes, fmt.Sprintf("created the worktree of environment %s again, which wasn't a git worktree", id))
+	} else if err != nil {
+		return nil, err
+	}
+
+	state, err := r.loadState(ctx, worktree)
+	if err != nil {
+		return nil, err
+	}
+	// Rebuilding the state requires an engine
+	if state == nil && (r.client != nil || environment.Initialized()) {
+		name, _, _ := strings.Cut(id, "/")
+		slog.Info("Rebuilding environment without state", "id", id)
+		env, err := environment.New(ctx, id, name, worktree, r.client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rebuild the environment: %w", err)
+		}
+		r.track(env)
+		if err := r.propagateToWorktree(ctx, env, "Repair env "+name, "Rebuild the environment after an interrupted operation"); err != nil {
+			return nil, err
+		}
+		fixes = append(fixes, fmt.Sprintf("rebuilt the missing state of environment %s from its configuration", id))
+	}
+	return fixes, nil
+}
+
+// orphanWorktrees returns the worktrees of the fork, by environment ID, whose
+// branch doesn't exist anymore. The worktrees of every repository share the
+// same directory: the others are recognized by their .git file.
+func (r *Repository) orphanWorktrees(ctx context.Context) (map[string]string, error) {
+	root, err := worktreePath("")
+	if err != nil {
+		return nil, err
+	}
+	worktrees, err := filepath.Glob(filepath.Join(root, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	// git records the real paths of the worktrees
+	forkWorktrees := filepath.Join(r.forkRepoPath, "worktrees")
+	if resolved, err := filepath.EvalSymlinks(forkWorktrees); err == nil {
+		forkWorktrees = resolved
+	}
+
+	orphans := map[string]string{}
+	for _, worktree := range worktrees {
+		gitfile, err := os.ReadFile(filepath.Join(worktree, ".git"))
+		if err != nil {
+			continue
+		}
+		gitdir, found := strings.CutPrefix(strings.TrimSpace(string(gitfile)), "gitdir: ")
+		if !found || filepath.Dir(gitdir) != forkWorktrees {
+			continue
+		}
+		id, err := filepath.Rel(root, worktree)
+		if err != nil {
+			return nil, err
+		}
+		id = filepath.ToSlash(id)
+		exists, err := branchExists(ctx, r.forkRepoPath, id)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			orphans[id] = worktree
+		}
+	}
+	return orphans, nil
+}
+
+// branchExists reports whether the branch exists in the repository. Failing
+// to check it, e.g. because ctx is done, is an error rather than false.
+func branchExists(ctx context.Context, repo, branch string) (bool, error) {
+	_, err := runGitCommand(ctx, repo, "show-ref", "--verify", "--quiet", "refs/heads/"+branch)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -2,12 +2,17 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 
+	"dagger.io/dagger"
 	"github.com/dagger/container-use/environment"
 	petname "github.com/dustinkirkland/golang-petname"
 )
@@ -17,25 +22,43 @@ const (
 	cuRepoPath         = cuGlobalConfigPath + "/repos"
 	cuWorktreePath     = cuGlobalConfigPath + "/worktrees"
 	containerUseRemote = "container-use"
-	gitNotesLogRef     = "container-use"
+	gitNotesLogRef     = environment.NotesRef
 	gitNotesStateRef   = "container-use-state"
 )
 
 type Repository struct {
 	userRepoPath string
 	forkRepoPath string
+
+	client *dagger.Client
 }
 
+var (
+	ErrNotGitRepository = errors.New("source is not a git repository")
+	ErrNoCommits        = errors.New("source repository has no commits")
+)
+
 func Open(ctx context.Context, repo string) (*Repository, error) {
+	if info, err := os.Stat(repo); err != nil {
+		return nil, fmt.Errorf("invalid source %s: %w", repo, err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("invalid source %s: not a directory", repo)
+	}
+
 	output, err := runGitCommand(ctx, repo, "rev-parse", "--show-toplevel")
 	if err != nil {
 		if strings.Contains(err.Error(), "not a git repository") {
-			return nil, errors.New("you must be in a git repository to use container-use")
+			return nil, fmt.Errorf("%w: %s (run `git init` and commit your files to use container-use)", ErrNotGitRepository, repo)
 		}
 		return nil, err
 	}
 	userRepoPath := strings.TrimSpace(output)
 
+	// Environments branch off the current commit
+	if _, err := runGitCommand(ctx, userRepoPath, "rev-parse", "--verify", "HEAD"); err != nil {
+		return nil, fmt.Errorf("%w: %s (commit your files to use container-use)", ErrNoCommits, userRepoPath)
+	}
+
 	forkRepoPath, err := getContainerUseRemote(ctx, userRepoPath)
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
@@ -59,9 +82,34 @@ func Open(ctx context.Context, repo string) (*Repository, error) {
 		return nil, fmt.Errorf("unable to set container-use remote: %w", err)
 	}
 
+	r.repairOnce(ctx)
+
 	return r, nil
 }
 
+// ReattachServices restarts the background services of the environment that
+// were running when the process that started them exited, see
+// Environment.ReattachServices, and persists their new state. It's meant for
+// the operations on services: loading an environment doesn't restart them.
+// Services that can't be reattached are forgotten and returned as an error.
+func (r *Repository) ReattachServices(ctx context.Context, env *environment.Environment) error {
+	if !env.HasDetachedServices() {
+		return nil
+	}
+	reattachErr := env.ReattachServices(ctx)
+	// The services reattached and lost are reported in the notes
+	if err := r.Update(ctx, env, "Reattach services", "Reattach the background services after a restart"); err != nil {
+		return err
+	}
+	return reattachErr
+}
+
+// SetClient pins the environments created and loaded through the repository to
+// the given dagger engine instead of the global one.
+func (r *Repository) SetClient(client *dagger.Client) {
+	r.client = client
+}
+
 func (r *Repository) ensureFork(ctx context.Context) error {
 	// Make sure the fork repo path exists, otherwise create it
 	_, err := os.Stat(r.forkRepoPath)
@@ -116,6 +164,13 @@ func (r *Repository) exists(ctx context.Context, id string) error {
 }
 
 func (r *Repository) Get(ctx context.Context, id string) (*environment.Environment, error) {
+	ephemeralMu.Lock()
+	ephemeral, ok := ephemeralEnvironments[id]
+	ephemeralMu.Unlock()
+	if ok {
+		return ephemeral.Clone(), nil
+	}
+
 	if err := r.exists(ctx, id); err != nil {
 		return nil, err
 	}
@@ -131,35 +186,217 @@ func (r *Repository) Get(ctx context.Context, id string) (*environment.Environme
 		return nil, err
 	}
 
-	env, err := environment.Load(ctx, id, name, state, worktree)
+	env, err := environment.Load(ctx, id, name, state, worktree, r.client)
 	if err != nil {
 		return nil, err
 	}
+	r.track(env)
 
 	return env, nil
 }
 
-func (r *Repository) Create(ctx context.Context, name, explanation string) (*environment.Environment, error) {
+type CreateOpts struct {
+	// Reuse returns an existing environment created with the same name from the
+	// same source state (commit, uncommitted changes and configuration) instead of
+	// building a new one.
+	Reuse bool
+}
+
+func (r *Repository) Create(ctx context.Context, name, explanation string, opts CreateOpts) (*environment.Environment, error) {
+	var cacheKey string
+	if opts.Reuse {
+		var err error
+		cacheKey, err = r.sourceCacheKey(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := r.findByCacheKey(ctx, cacheKey)
+		if err != nil {
+			return nil, err
+		}
+		if existing != "" {
+			slog.Info("Reusing existing environment", "id", existing, "cache-key", cacheKey)
+			return r.Get(ctx, existing)
+		}
+	}
+
 	id := fmt.Sprintf("%s/%s", name, petname.Generate(2, "-"))
 	worktree, err := r.initializeWorktree(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	env, err := environment.New(ctx, id, name, worktree)
+	env, err := environment.New(ctx, id, name, worktree, r.client)
 	if err != nil {
 		return nil, err
 	}
+	r.track(env)
 
 	if err := r.propagateToWorktree(ctx, env, "Create env "+name, explanation); err != nil {
 		return nil, err
 	}
 
+	if cacheKey != "" {
+		if err := r.setCacheKey(ctx, id, cacheKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return env, nil
+}
+
+// CreateFromContainerID creates an environment whose initial state is a
+// container prepared by an external dagger pipeline.
+func (r *Repository) CreateFromContainerID(ctx context.Context, name, explanation string, containerID dagger.ContainerID) (*environment.Environment, error) {
+	container, err := environment.LoadContainer(ctx, r.client, containerID)
+	if err != nil {
+		return nil, err
+	}
+	return r.createFromContainer(ctx, name, explanation, container)
+}
+
+// CreateFromLocalCheckpoint creates an environment from a checkpoint saved by
+// Environment.CheckpointLocal.
+func (r *Repository) CreateFromLocalCheckpoint(ctx context.Context, name, explanation, ref string) (*environment.Environment, error) {
+	container, err := environment.LoadLocalCheckpoint(ctx, r.client, ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.createFromContainer(ctx, name, explanation, container)
+}
+
+func (r *Repository) createFromContainer(ctx context.Context, name, explanation string, container *dagger.Container) (*environment.Environment, error) {
+	id := fmt.Sprintf("%s/%s", name, petname.Generate(2, "-"))
+	worktree, err := r.initializeWorktree(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := environment.NewFromContainer(ctx, id, name, worktree, container, r.client)
+	if err != nil {
+		return nil, err
+	}
+	r.track(env)
+
+	if err := r.propagateToWorktree(ctx, env, "Create env "+name, explanation); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+type ForkOpts struct {
+	// Ephemeral forks skip the branch, worktree and notes for cheap throwaway
+	// experiments: they only live in the memory of this process and are lost
+	// when it exits. Their changes can't be merged, and their configuration
+	// can't be updated.
+	Ephemeral bool
+}
+
+// ephemeralEnvironments are the forks created with ForkOpts.Ephemeral. Each
+// operation gets a copy, stored back by Update, like the other environments
+// are loaded from and saved to git.
+var (
+	ephemeralMu           sync.Mutex
+	ephemeralEnvironments = map[string]*environment.Environment{}
+)
+
+// Fork creates a new environment from a version of the parent (0 for the
+// latest). The fork is recorded in the logs of both environments. Ephemeral
+// environments have no branch to fork from, so their forks must be ephemeral
+// too.
+func (r *Repository) Fork(ctx context.Context, parent *environment.Environment, name, explanation string, version int, opts ForkOpts) (*environment.Environment, error) {
+	if parent.Ephemeral && !opts.Ephemeral {
+		return nil, fmt.Errorf("environment %s is ephemeral: it has no branch to fork from, fork it as ephemeral too", parent.ID)
+	}
+	id := fmt.Sprintf("%s/%s", name, petname.Generate(2, "-"))
+	if opts.Ephemeral {
+		fork, err := parent.Fork(ctx, id, name, "", version)
+		if err != nil {
+			return nil, err
+		}
+		fork.Ephemeral = true
+		ephemeralMu.Lock()
+		ephemeralEnvironments[id] = fork.Clone()
+		ephemeralMu.Unlock()
+		return fork, nil
+	}
+
+	worktree, err := r.initializeForkWorktree(ctx, id, parent.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	fork, err := parent.Fork(ctx, id, name, worktree, version)
+	if err != nil {
+		return nil, err
+	}
+	r.track(fork)
+
+	if err := r.Update(ctx, fork, "Fork env "+parent.ID, explanation); err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		version = parent.History.LatestVersion()
+	}
+	if err := r.addGitNote(ctx, parent, fmt.Sprintf("Fork %s created from version %d\n%s\n\n", fork.ID, version, explanation)); err != nil {
+		return nil, err
+	}
+
+	return fork, nil
+}
+
+// Import restores an environment exported with Environment.ExportState.
+func (r *Repository) Import(ctx context.Context, data []byte, explanation string) (*environment.Environment, error) {
+	var exported struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &exported); err != nil || exported.ID == "" {
+		return nil, errors.New("invalid exported environment")
+	}
+	if err := r.exists(ctx, exported.ID); err == nil {
+		return nil, fmt.Errorf("environment %q already exists", exported.ID)
+	}
+
+	worktree, err := r.initializeWorktree(ctx, exported.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := environment.ImportState(ctx, data, worktree, r.client)
+	if err != nil {
+		return nil, err
+	}
+	r.track(env)
+
+	if err := r.propagateToWorktree(ctx, env, "Import env "+env.Name, explanation); err != nil {
+		return nil, err
+	}
+
 	return env, nil
 }
 
+// track records the notes of the background activity of an environment, such
+// as service restarts, in its git notes as it happens.
+func (r *Repository) track(env *environment.Environment) {
+	env.Source = r.userRepoPath
+	env.RecordNote = func(ctx context.Context, note string) error {
+		return r.addGitNote(ctx, env, note)
+	}
+}
+
 func (r *Repository) Update(ctx context.Context, env *environment.Environment, operation, explanation string) error {
 	note := env.Notes.Pop()
+	if env.Ephemeral {
+		// Only kept in memory, unless it was deleted meanwhile
+		ephemeralMu.Lock()
+		defer ephemeralMu.Unlock()
+		if _, ok := ephemeralEnvironments[env.ID]; ok {
+			ephemeralEnvironments[env.ID] = env.Clone()
+		}
+		return nil
+	}
 	if strings.TrimSpace(note) != "" {
 		if err := r.addGitNote(ctx, env, note); err != nil {
 			return err
@@ -168,6 +405,20 @@ func (r *Repository) Update(ctx context.Context, env *environment.Environment, o
 	return r.propagateToWorktree(ctx, env, operation, explanation)
 }
 
+// Watch syncs the changes of the source into the environment as they happen,
+// see Environment.Watch, and persists every sync before calling onChange.
+func (r *Repository) Watch(ctx context.Context, env *environment.Environment, onChange func()) (func(), error) {
+	return env.Watch(ctx, func() {
+		if err := r.Update(ctx, env, "Sync from host", "Sync changes from the host"); err != nil {
+			slog.Error("Failed to persist the synced changes", "environment", env.ID, "err", err)
+			return
+		}
+		if onChange != nil {
+			onChange()
+		}
+	})
+}
+
 func (r *Repository) List(ctx context.Context) ([]string, error) {
 	branches, err := runGitCommand(ctx, r.forkRepoPath, "branch", "--format", "%(refname:short)")
 	if err != nil {
@@ -175,6 +426,9 @@ func (r *Repository) List(ctx context.Context) ([]string, error) {
 	}
 
 	envs := []string{}
+	ephemeralMu.Lock()
+	envs = append(envs, slices.Sorted(maps.Keys(ephemeralEnvironments))...)
+	ephemeralMu.Unlock()
 	for _, branch := range strings.Split(branches, "\n") {
 		branch = strings.TrimSpace(branch)
 		// FIXME(aluzzardi): This logic is broken
@@ -189,15 +443,28 @@ func (r *Repository) List(ctx context.Context) ([]string, error) {
 }
 
 func (r *Repository) Delete(ctx context.Context, id string) error {
+	ephemeralMu.Lock()
+	_, ephemeral := ephemeralEnvironments[id]
+	delete(ephemeralEnvironments, id)
+	ephemeralMu.Unlock()
+	if ephemeral {
+		return environment.StopServices(ctx, id)
+	}
+
 	if err := r.exists(ctx, id); err != nil {
 		return err
 	}
 
+	// The environment is deleted even if some of its services failed to stop
+	var errs []error
+	if err := environment.StopServices(ctx, id); err != nil {
+		errs = append(errs, err)
+	}
 	if err := r.deleteWorktree(id); err != nil {
-		return err
+		errs = append(errs, err)
 	}
 	if err := r.deleteLocalRemoteBranch(id); err != nil {
-		return err
+		errs = append(errs, err)
 	}
-	return nil
+	return errors.Join(errs...)
 }
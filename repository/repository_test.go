@@ -0,0 +1,292 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/dagger/container-use/environment"
+	"github.com/mitchellh/go-homedir"
+)
+
+// testSource returns an empty directory that git doesn't consider part of any
+// repository above it.
+func testSource(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+	t.Setenv("LC_ALL", "C")
+	return dir
+}
+
+func TestOpenNonGitSource(t *testing.T) {
+	source := testSource(t)
+
+	_, err := Open(context.Background(), source)
+	if !errors.Is(err, ErrNotGitRepository) {
+		t.Fatalf("expected ErrNotGitRepository, got %v", err)
+	}
+	if !strings.Contains(err.Error(), source) {
+		t.Errorf("expected the error to name the source, got %q", err)
+	}
+}
+
+func TestOpenSourceWithoutCommits(t *testing.T) {
+	source := testSource(t)
+	if out, err := exec.Command("git", "-C", source, "init", "-q").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s: %s", err, out)
+	}
+
+	if _, err := Open(context.Background(), source); !errors.Is(err, ErrNoCommits) {
+		t.Fatalf("expected ErrNoCommits, got %v", err)
+	}
+}
+
+func TestOpenInvalidSource(t *testing.T) {
+	source := testSource(t)
+	file := filepath.Join(source, "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{file, filepath.Join(source, "missing")} {
+		_, err := Open(context.Background(), path)
+		if err == nil || errors.Is(err, ErrNotGitRepository) {
+			t.Errorf("%s: expected an invalid source error, got %v", path, err)
+		}
+	}
+}
+
+// testClient connects to the dagger engine, or skips the test without one:
+// run the tests with `dagger run go test ./...` to include them.
+func testClient(t *testing.T) *dagger.Client {
+	t.Helper()
+	if os.Getenv("DAGGER_SESSION_PORT") == "" {
+		t.Skip("no dagger engine, run the tests with `dagger run go test ./...`")
+	}
+	client, err := dagger.Connect(context.Background(), dagger.WithLogOutput(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testRepository opens a repository with a single commit, configured to use
+// alpine, with its forks and worktrees in a temporary home.
+func testRepository(t *testing.T, client *dagger.Client) *Repository {
+	t.Helper()
+	repo := testGitRepository(t)
+	repo.SetClient(client)
+	return repo
+}
+
+// testGitRepository is testRepository without an engine, for the git
+// operations only.
+func testGitRepository(t *testing.T) *Repository {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	homedir.DisableCache = true
+	for _, variable := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(variable, "test")
+	}
+	for _, variable := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(variable, "test@example.com")
+	}
+
+	source := testSource(t)
+	files := map[string]string{
+		filepath.Join(".container-use", "AGENT.md"):         "Test environment\n",
+		filepath.Join(".container-use", "environment.json"): `{"base_image": "alpine:3.21"}`,
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(source, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"commit", "-q", "-m", "init"},
+	} {
+		testGit(t, source, args...)
+	}
+
+	repo, err := Open(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func testGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %s: %s", args[0], err, out)
+	}
+}
+
+func TestDeleteStopsServices(t *testing.T) {
+	ctx := context.Background()
+	repo := testRepository(t, testClient(t))
+
+	env, err := repo.Create(ctx, "test", "Test deleting an environment", CreateOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := env.RunBackground(ctx, "Serve", "nc -lk -p 8080 -e echo hello", "sh", []int{8080}, environment.RunBackgroundOpts{
+		ExposeOnHost: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	external := service.Endpoints[8080].External
+	if external == "" {
+		t.Fatalf("port 8080 isn't exposed on the host: %s", service.Endpoints[8080].Note)
+	}
+	conn, err := net.DialTimeout("tcp", external, time.Second)
+	if err != nil {
+		t.Fatalf("the tunnel doesn't accept connections before deleting: %s", err)
+	}
+	conn.Close()
+
+	if err := repo.Delete(ctx, env.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn, err := net.DialTimeout("tcp", external, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf("the tunnel on %s still accepts connections after deleting the environment", external)
+	}
+	if _, err := env.FindService(service.ID); err == nil {
+		t.Errorf("service %s is still tracked after deleting the environment", service.ID)
+	}
+}
+
+// testWorktree creates the branch and worktree of an environment, without its
+// state, as an interrupted Create leaves them.
+func testWorktree(t *testing.T, repo *Repository, id string) string {
+	t.Helper()
+	worktree, err := repo.initializeWorktree(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return worktree
+}
+
+func TestRepairRemovesWorktreeWithoutBranch(t *testing.T) {
+	repo := testGitRepository(t)
+	worktree := testWorktree(t, repo, "test/orphan")
+	kept := testWorktree(t, repo, "test/kept")
+	testGit(t, repo.forkRepoPath, "update-ref", "-d", "refs/heads/test/orphan")
+
+	fixes, err := repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixes) != 1 || !strings.Contains(fixes[0], "test/orphan") {
+		t.Errorf("expected the orphan worktree to be reported, got %q", fixes)
+	}
+	if _, err := os.Stat(worktree); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the worktree without branch to be removed, got %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("expected the worktree with a branch to be kept, got %v", err)
+	}
+}
+
+func TestRepairRecreatesBrokenWorktree(t *testing.T) {
+	repo := testGitRepository(t)
+	worktree := testWorktree(t, repo, "test/broken")
+	if err := os.Remove(filepath.Join(worktree, ".git")); err != nil {
+		t.Fatal(err)
+	}
+
+	fixes, err := repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixes) != 1 || !strings.Contains(fixes[0], "test/broken") {
+		t.Errorf("expected the broken worktree to be reported, got %q", fixes)
+	}
+	if _, err := os.Stat(filepath.Join(worktree, ".git")); err != nil {
+		t.Errorf("expected the worktree to be a git worktree again, got %v", err)
+	}
+}
+
+func TestRepairKeepsWorktreeOnGitFailure(t *testing.T) {
+	repo := testGitRepository(t)
+	worktree := testWorktree(t, repo, "test/orphan")
+	testGit(t, repo.forkRepoPath, "update-ref", "-d", "refs/heads/test/orphan")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := repo.Repair(ctx); err == nil {
+		t.Error("expected the repair to fail when git can't run")
+	}
+	if _, err := os.Stat(worktree); err != nil {
+		t.Errorf("expected the worktree to be kept when its branch can't be checked, got %v", err)
+	}
+}
+
+func TestRepairKeepsDeletedTrackingBranch(t *testing.T) {
+	repo := testGitRepository(t)
+	testWorktree(t, repo, "test/untracked")
+	testGit(t, repo.userRepoPath, "branch", "-q", "-D", "test/untracked")
+
+	fixes, err := repo.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixes) != 0 {
+		t.Errorf("expected nothing to repair, got %q", fixes)
+	}
+	if exists, err := branchExists(context.Background(), repo.userRepoPath, "test/untracked"); err != nil || exists {
+		t.Errorf("expected the deleted tracking branch to stay deleted, got %v, %v", exists, err)
+	}
+}
+
+func TestRepairRebuildsMissingState(t *testing.T) {
+	ctx := context.Background()
+	repo := testRepository(t, testClient(t))
+	testWorktree(t, repo, "test/stateless")
+
+	fixes, err := repo.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixes) != 1 || !strings.Contains(fixes[0], "test/stateless") {
+		t.Errorf("expected the missing state to be reported, got %q", fixes)
+	}
+	if _, err := repo.Get(ctx, "test/stateless"); err != nil {
+		t.Errorf("expected the environment to load once repaired, got %v", err)
+	}
+}
+
+func TestForkEphemeralRequiresEphemeral(t *testing.T) {
+	repo := testGitRepository(t)
+	parent := &environment.Environment{ID: "test/ephemeral", Name: "test", Ephemeral: true}
+
+	_, err := repo.Fork(context.Background(), parent, "fork", "Fork an ephemeral environment", 0, ForkOpts{})
+	if err == nil || !strings.Contains(err.Error(), "ephemeral") {
+		t.Fatalf("expected forking an ephemeral environment into a persistent one to be rejected, got %v", err)
+	}
+	ids, err := repo.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected no environment to be created, got %q", ids)
+	}
+}